@@ -0,0 +1,272 @@
+package neptulon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/neptulon/cmap"
+	"github.com/neptulon/shortid"
+)
+
+// Backplane connects multiple Server instances (nodes) so that messages can be routed to client connections on other nodes.
+// Backplane only transports opaque messages between nodes, and the servers handle the routing.
+// See MemoryHub and TCPBackplane for the built-in implementations.
+type Backplane interface {
+	// Start connects the node with the given ID to the backplane.
+	// Handler should be called with each message sent to the node, in the order they were sent.
+	Start(nodeID string, handler func(data []byte)) error
+
+	// Send sends the message to the node with the given ID.
+	Send(nodeID string, data []byte) error
+
+	// Broadcast sends the message to all the other nodes, and returns the number of nodes that it was sent to.
+	Broadcast(data []byte) (int, error)
+
+	// Close disconnects the node from the backplane.
+	Close() error
+}
+
+// Backplane message types.
+const (
+	bpRequest      = "request"      // request to be sent through a connection on the receiving node, if any
+	bpResponse     = "response"     // response to a forwarded request, sent back to the originating node
+	bpNotFound     = "notFound"     // reply to a forwarded request from a node which does not have the connection
+	bpNotification = "notification" // notification to be sent through a connection on the receiving node, if any
+	bpBroadcast    = "broadcast"    // notification to be sent through all connections on the receiving node
+	bpPublish      = "publish"      // data published to a topic
+)
+
+// backplaneMessage is a message sent between nodes through the backplane.
+type backplaneMessage struct {
+	Type   string          `json:"type"`
+	Node   string          `json:"node"`             // ID of the originating node
+	ConnID string          `json:"connId,omitempty"` // target connection ID for requests and notifications
+	ID     string          `json:"id,omitempty"`     // request ID on the originating node, for requests and responses
+	Method string          `json:"method,omitempty"`
+	Topic  string          `json:"topic,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"` // request params, or published data
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *resError       `json:"error,omitempty"`
+}
+
+// SetBackplane connects the server to other servers through the backplane, with an auto generated node ID.
+// Once connected, requests and notifications sent to connection IDs that are not on this server are forwarded to the other nodes,
+// and Broadcast and Publish reach the connections on all the nodes. Params and results are relayed between the nodes in JSON,
+// so []byte values reach the connections on the other nodes as base64 encoded strings. This should be called before starting the server.
+func (s *Server) SetBackplane(b Backplane) error {
+	id, err := shortid.UUID()
+	if err != nil {
+		return err
+	}
+	s.nodeID = id
+	s.remotePending = cmap.New()
+	s.backplane = b
+	if err := b.Start(id, s.handleBackplane); err != nil {
+		s.backplane = nil
+		return fmt.Errorf("server: failed to start backplane: %v", err)
+	}
+	return nil
+}
+
+// NodeID returns the node ID of the server, once it is connected to a backplane with SetBackplane.
+func (s *Server) NodeID() string {
+	return s.nodeID
+}
+
+// sendBackplane encodes and sends the message to the given node, or to all the other nodes if the node ID is empty.
+func (s *Server) sendBackplane(nodeID string, m *backplaneMessage) error {
+	if nodeID == "" {
+		_, err := s.broadcastBackplane(m)
+		return err
+	}
+	m.Node = s.nodeID
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.backplane.Send(nodeID, data)
+}
+
+// broadcastBackplane encodes and sends the message to all the other nodes, and returns the number of nodes that it was sent to.
+func (s *Server) broadcastBackplane(m *backplaneMessage) (int, error) {
+	m.Node = s.nodeID
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	return s.backplane.Broadcast(data)
+}
+
+// remoteReq is a request forwarded to the other nodes, waiting for the response from the node that has the connection.
+type remoteReq struct {
+	*pendingReq
+	countMutex sync.Mutex
+	sent       bool // set once the request is sent, along with the number of nodes it was sent to
+	nodes      int
+	notFound   int // number of nodes that replied that they do not have the connection
+}
+
+// setSent records the number of nodes that the request was sent to, and returns true if all of them replied that they do not have the connection.
+func (r *remoteReq) setSent(nodes int) bool {
+	r.countMutex.Lock()
+	defer r.countMutex.Unlock()
+	r.sent, r.nodes = true, nodes
+	return r.notFound >= r.nodes
+}
+
+// addNotFound records the reply of a node which does not have the connection,
+// and returns true if all the nodes that the request was sent to replied so.
+func (r *remoteReq) addNotFound() bool {
+	r.countMutex.Lock()
+	defer r.countMutex.Unlock()
+	r.notFound++
+	return r.sent && r.notFound >= r.nodes
+}
+
+// forwardRequest sends the request to the other nodes, one of which should have the connection with the given ID.
+// resHandler is called when a response is returned through the backplane, when the context is done or the response timeout passes,
+// or with an ErrCodeDisconnected error response once all the nodes reply that they do not have the connection.
+// Returns an error right away if there are no other nodes. Response context does not have a connection.
+func (s *Server) forwardRequest(ctx context.Context, connID string, method string, params interface{}, resHandler func(ctx *ResCtx) error) (reqID string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	id, err := shortid.UUID()
+	if err != nil {
+		return "", err
+	}
+
+	// register response handler beforehand as response can arrive before send returns
+	p := &pendingReq{id: id, ctx: ctx, handler: resHandler}
+	r := &remoteReq{pendingReq: p}
+	p.mutex.Lock()
+	s.remotePending.Set(id, r)
+	if s.resTimeout > 0 {
+		p.timer = time.AfterFunc(s.resTimeout, func() {
+			s.completeRemote(p, newResCtx(nil, id, rawValue{}, &resError{Code: ErrCodeTimeout, Message: "Response was not received in time."}))
+		})
+	}
+	if ctx.Done() != nil {
+		p.stop = context.AfterFunc(ctx, func() {
+			code, msg := ErrCodeCanceled, "Request was canceled."
+			if ctx.Err() == context.DeadlineExceeded {
+				code, msg = ErrCodeTimeout, "Response was not received before the context deadline."
+			}
+			s.completeRemote(p, newResCtx(nil, id, rawValue{}, &resError{Code: code, Message: msg}))
+		})
+	}
+	p.mutex.Unlock()
+
+	n, err := s.broadcastBackplane(&backplaneMessage{Type: bpRequest, ConnID: connID, ID: id, Method: method, Params: raw})
+	if err == nil && n == 0 {
+		err = fmt.Errorf("connection with requested ID: %v does not exist", connID)
+	}
+	if err != nil {
+		p.complete()
+		s.remotePending.Delete(id)
+		return "", err
+	}
+	if r.setSent(n) {
+		s.completeRemote(p, newResCtx(nil, id, rawValue{}, errConnNotFound))
+	}
+	return id, nil
+}
+
+// errConnNotFound is the error response to forwarded requests for connections that none of the nodes have.
+var errConnNotFound = &resError{Code: ErrCodeDisconnected, Message: "Connection was not found on any node."}
+
+// completeRemote asynchronously calls the response handler of the forwarded request with the given response context.
+// Does nothing if the request was already completed.
+func (s *Server) completeRemote(p *pendingReq, ctx *ResCtx) {
+	if !p.complete() {
+		return
+	}
+	s.remotePending.Delete(p.id)
+	ctx.ctx = p.ctx
+
+	go func() {
+		if err := p.handler(ctx); err != nil {
+			log.Printf("server: error while handling forwarded response: %v", err)
+		}
+	}()
+}
+
+// forwardNotification sends the notification to the other nodes, one of which should have the connection with the given ID.
+func (s *Server) forwardNotification(connID string, method string, params interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.sendBackplane("", &backplaneMessage{Type: bpNotification, ConnID: connID, Method: method, Params: raw})
+}
+
+// handleBackplane handles a message received from another node through the backplane.
+func (s *Server) handleBackplane(data []byte) {
+	var m backplaneMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Printf("server: backplane: received a malformed message: %v", err)
+		return
+	}
+
+	var params interface{}
+	if m.Params != nil {
+		params = m.Params
+	}
+
+	switch m.Type {
+	case bpRequest:
+		conn, ok := s.conns.GetOk(m.ConnID)
+		if !ok {
+			if err := s.sendBackplane(m.Node, &backplaneMessage{Type: bpNotFound, ID: m.ID}); err != nil {
+				log.Printf("server: backplane: error replying to forwarded request %v: %v", m.ID, err)
+			}
+			return
+		}
+		_, err := conn.(*Conn).SendRequest(m.Method, params, func(ctx *ResCtx) error {
+			res := &backplaneMessage{Type: bpResponse, ID: m.ID}
+			var err error
+			if res.Result, err = ctx.result.json(); err != nil {
+				res.Error = &resError{Code: ErrCodeInternal, Message: err.Error()}
+			} else if !ctx.Success {
+				res.Error = &resError{Code: ctx.ErrorCode, Message: ctx.ErrorMessage, Data: ctx.errorData}
+			}
+			if err := s.sendBackplane(m.Node, res); err != nil {
+				log.Printf("server: backplane: error sending response to forwarded request %v: %v", m.ID, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("server: backplane: error sending forwarded request to %v: %v", m.ConnID, err)
+			s.sendBackplane(m.Node, &backplaneMessage{Type: bpResponse, ID: m.ID, Error: &resError{Code: ErrCodeDisconnected, Message: err.Error()}})
+		}
+	case bpResponse:
+		if r, ok := s.remotePending.GetOk(m.ID); ok {
+			s.completeRemote(r.(*remoteReq).pendingReq, newResCtx(nil, m.ID, jsonValue(m.Result), m.Error))
+		}
+	case bpNotFound:
+		if r, ok := s.remotePending.GetOk(m.ID); ok && r.(*remoteReq).addNotFound() {
+			s.completeRemote(r.(*remoteReq).pendingReq, newResCtx(nil, m.ID, rawValue{}, errConnNotFound))
+		}
+	case bpNotification:
+		if conn, ok := s.conns.GetOk(m.ConnID); ok {
+			if err := conn.(*Conn).SendNotification(m.Method, params); err != nil {
+				log.Printf("server: backplane: error sending forwarded notification to %v: %v", m.ConnID, err)
+			}
+		}
+	case bpBroadcast:
+		notifyAll(s.connsWhere(nil), m.Method, params)
+	case bpPublish:
+		s.publishLocal(m.Topic, params)
+	default:
+		log.Printf("server: backplane: received a message of unknown type: %v", m.Type)
+	}
+}
@@ -0,0 +1,79 @@
+package neptulon
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MemoryHub connects servers in the same process, i.e. for testing multi-node setups.
+// Each server should be given its own backplane with Backplane().
+type MemoryHub struct {
+	mutex sync.RWMutex
+	nodes map[string]func(data []byte) // node ID -> message handler
+}
+
+// NewMemoryHub creates a new in-memory hub.
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{nodes: make(map[string]func(data []byte))}
+}
+
+// Backplane returns a new backplane connected to the hub, to be used with Server.SetBackplane.
+func (h *MemoryHub) Backplane() Backplane {
+	return &memoryBackplane{hub: h}
+}
+
+// memoryBackplane is a single node's connection to a MemoryHub.
+// Messages are delivered synchronously, in the goroutine of the sender.
+type memoryBackplane struct {
+	hub    *MemoryHub
+	nodeID string
+}
+
+func (b *memoryBackplane) Start(nodeID string, handler func(data []byte)) error {
+	b.hub.mutex.Lock()
+	defer b.hub.mutex.Unlock()
+	if _, ok := b.hub.nodes[nodeID]; ok {
+		return fmt.Errorf("backplane: node %v is already connected", nodeID)
+	}
+	b.nodeID = nodeID
+	b.hub.nodes[nodeID] = handler
+	return nil
+}
+
+func (b *memoryBackplane) Send(nodeID string, data []byte) error {
+	b.hub.mutex.RLock()
+	handler, ok := b.hub.nodes[nodeID]
+	b.hub.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("backplane: node %v is not connected", nodeID)
+	}
+	handler(data)
+	return nil
+}
+
+func (b *memoryBackplane) Broadcast(data []byte) (int, error) {
+	b.hub.mutex.RLock()
+	var handlers []func(data []byte)
+	for id, handler := range b.hub.nodes {
+		if id != b.nodeID {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.hub.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(data)
+	}
+	return len(handlers), nil
+}
+
+func (b *memoryBackplane) Close() error {
+	b.hub.mutex.Lock()
+	defer b.hub.mutex.Unlock()
+	if _, ok := b.hub.nodes[b.nodeID]; !ok {
+		return errors.New("backplane: node is not connected")
+	}
+	delete(b.hub.nodes, b.nodeID)
+	return nil
+}
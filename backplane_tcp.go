@@ -0,0 +1,406 @@
+package neptulon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPBackplane connects servers over TCP, as a reference Backplane implementation.
+// Each node listens on its own address and keeps connecting to the addresses of all the other nodes in the background,
+// so nodes can be started in any order. Messages are sent as length-prefixed frames, and only reach the nodes that are connected at the time.
+// Nodes prove that they know the shared secret set with SetSecret to each other when connecting, but messages are not encrypted,
+// so the backplane should only be used on a trusted network.
+type TCPBackplane struct {
+	laddr    string
+	peers    []string // addresses of the other nodes
+	secret   []byte
+	nodeID   string
+	handler  func(data []byte)
+	listener net.Listener
+	ctx      context.Context // canceled when the backplane is closed, to stop dialing the other nodes
+	cancel   context.CancelFunc
+	mutex    sync.Mutex          // protects the connection maps and the closed flag
+	outbound map[string]*tcpPeer // peer address -> outgoing connection
+	inbound  map[net.Conn]bool   // incoming connections
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// tcpPeer is an outgoing connection to another node.
+type tcpPeer struct {
+	conn   net.Conn
+	nodeID string
+	mutex  sync.Mutex // serializes writes
+}
+
+// Maximum size of a single message and of a node ID, the timeout for dialing and authenticating the other nodes,
+// and the timeout for writing a message.
+const (
+	tcpMaxFrameSize     = 64 << 20
+	tcpMaxNodeIDSize    = 256
+	tcpHandshakeTimeout = time.Second * 5
+	tcpWriteTimeout     = time.Second * 5
+)
+
+// tcpRedial is the backoff for reconnecting to the other nodes.
+var tcpRedial = Backoff{Min: time.Millisecond * 100, Max: time.Second * 5, Factor: 2, Jitter: 0.2}
+
+// NewTCPBackplane creates a new TCP backplane which listens on the given address (i.e. 127.0.0.1:4000)
+// and connects to the given addresses of the other nodes.
+func NewTCPBackplane(laddr string, peers ...string) *TCPBackplane {
+	return &TCPBackplane{
+		laddr:    laddr,
+		peers:    peers,
+		outbound: make(map[string]*tcpPeer),
+		inbound:  make(map[net.Conn]bool),
+	}
+}
+
+// SetSecret sets the secret shared by all the nodes. Connections from and to the nodes which cannot prove that they know the same secret
+// are rejected. Secret is never sent over the network. This must be called before starting the backplane.
+func (b *TCPBackplane) SetSecret(secret string) {
+	b.secret = []byte(secret)
+}
+
+// Start starts listening for the connections from the other nodes, and connecting to them.
+// Secret should be set with SetSecret beforehand.
+func (b *TCPBackplane) Start(nodeID string, handler func(data []byte)) error {
+	if len(b.secret) == 0 {
+		return errors.New("backplane: no secret is set for authenticating the nodes")
+	}
+	if len(nodeID) > tcpMaxNodeIDSize {
+		return fmt.Errorf("backplane: node ID is longer than %v bytes", tcpMaxNodeIDSize)
+	}
+
+	l, err := net.Listen("tcp", b.laddr)
+	if err != nil {
+		return err
+	}
+
+	b.nodeID = nodeID
+	b.handler = handler
+	b.listener = l
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.wg.Add(1 + len(b.peers))
+	go b.accept()
+	for _, addr := range b.peers {
+		go b.connect(addr)
+	}
+	return nil
+}
+
+// Send sends the message to the node with the given ID, if it is connected.
+func (b *TCPBackplane) Send(nodeID string, data []byte) error {
+	p := b.peerByID(nodeID)
+	if p == nil {
+		return fmt.Errorf("backplane: node %v is not connected", nodeID)
+	}
+	return b.write(p, data)
+}
+
+// Broadcast sends the message to all the other nodes that are connected. Returns the number of nodes that the message was sent to,
+// and the first error, if any, after trying all the nodes.
+func (b *TCPBackplane) Broadcast(data []byte) (int, error) {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return 0, errors.New("backplane: use of closed backplane")
+	}
+	peers := make([]*tcpPeer, 0, len(b.outbound))
+	for _, p := range b.outbound {
+		peers = append(peers, p)
+	}
+	b.mutex.Unlock()
+
+	var n int
+	var firstErr error
+	for _, p := range peers {
+		if err := b.write(p, data); err == nil {
+			n++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return n, firstErr
+}
+
+// Close stops listening and closes all the connections to the other nodes.
+func (b *TCPBackplane) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return errors.New("backplane: already closed")
+	}
+	b.closed = true
+	b.cancel()
+	err := b.listener.Close()
+	for _, p := range b.outbound {
+		p.conn.Close()
+	}
+	for c := range b.inbound {
+		c.Close()
+	}
+	b.mutex.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+// accept accepts incoming connections from the other nodes until the listener is closed.
+func (b *TCPBackplane) accept() {
+	defer b.wg.Done()
+	for {
+		c, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			c.Close()
+			return
+		}
+		b.inbound[c] = true
+		b.wg.Add(1)
+		b.mutex.Unlock()
+		go b.receive(c)
+	}
+}
+
+// receive authenticates the connecting node and then passes all the received messages to the handler.
+func (b *TCPBackplane) receive(c net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.inbound, c)
+		b.mutex.Unlock()
+		c.Close()
+	}()
+
+	c.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	if err := b.acceptHandshake(c); err != nil {
+		if !b.isClosed() {
+			log.Printf("backplane: rejected connection from %v: %v", c.RemoteAddr(), err)
+		}
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	for {
+		data, err := readFrame(c, tcpMaxFrameSize)
+		if err != nil {
+			if err != io.EOF && !b.isClosed() {
+				log.Printf("backplane: error reading from %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		b.handler(data)
+	}
+}
+
+// connect keeps an outgoing connection to the node with the given address until the backplane is closed, reconnecting when it is lost.
+func (b *TCPBackplane) connect(addr string) {
+	defer b.wg.Done()
+	for attempt := 0; ; {
+		p, err := b.dial(addr)
+		if err != nil {
+			if attempt == 0 && !b.isClosed() {
+				log.Printf("backplane: error connecting to %v, retrying in the background: %v", addr, err)
+			}
+			select {
+			case <-time.After(tcpRedial.delay(attempt)):
+				attempt++
+				continue
+			case <-b.ctx.Done():
+				return
+			}
+		}
+		attempt = 0
+
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			p.conn.Close()
+			return
+		}
+		b.outbound[addr] = p
+		b.mutex.Unlock()
+
+		// other node never writes to the connection after the handshake, so reading only returns once the connection is lost
+		io.Copy(io.Discard, p.conn)
+		p.conn.Close()
+
+		b.mutex.Lock()
+		delete(b.outbound, addr)
+		closed := b.closed
+		b.mutex.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// dial connects to the node with the given address and authenticates it.
+func (b *TCPBackplane) dial(addr string) (*tcpPeer, error) {
+	d := net.Dialer{Timeout: tcpHandshakeTimeout}
+	c, err := d.DialContext(b.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	id, err := b.dialHandshake(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return &tcpPeer{conn: c, nodeID: id}, nil
+}
+
+// Roles that the handshake MACs are bound to, so that a MAC computed by one side cannot be replayed as the other.
+const (
+	tcpRoleDialer   = 'd'
+	tcpRoleAcceptor = 'a'
+)
+
+// acceptHandshake authenticates the connecting node and proves the knowledge of the secret to it.
+// Accepting node sends a random challenge, and the connecting node replies with its own challenge, the MAC of the first one and its node ID.
+// Accepting node then replies with the MAC of the second challenge and its node ID.
+func (b *TCPBackplane) acceptHandshake(c net.Conn) error {
+	challenge, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(c, challenge); err != nil {
+		return err
+	}
+	frame, err := readFrame(c, 2*sha256.Size+tcpMaxNodeIDSize)
+	if err != nil {
+		return err
+	}
+	if len(frame) < 2*sha256.Size {
+		return errors.New("backplane: malformed handshake")
+	}
+	theirs, mac, id := frame[:sha256.Size], frame[sha256.Size:2*sha256.Size], frame[2*sha256.Size:]
+	if !hmac.Equal(mac, b.mac(tcpRoleDialer, challenge, id)) {
+		return errors.New("backplane: node does not know the shared secret")
+	}
+	return writeFrame(c, append(b.mac(tcpRoleAcceptor, theirs, []byte(b.nodeID)), b.nodeID...))
+}
+
+// dialHandshake is the connecting side of acceptHandshake. Returns the ID of the accepting node.
+func (b *TCPBackplane) dialHandshake(c net.Conn) (string, error) {
+	challenge, err := readFrame(c, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	if len(challenge) != sha256.Size {
+		return "", errors.New("backplane: malformed handshake")
+	}
+	ours, err := newChallenge()
+	if err != nil {
+		return "", err
+	}
+	frame := append(ours, b.mac(tcpRoleDialer, challenge, []byte(b.nodeID))...)
+	if err := writeFrame(c, append(frame, b.nodeID...)); err != nil {
+		return "", err
+	}
+	frame, err = readFrame(c, sha256.Size+tcpMaxNodeIDSize)
+	if err != nil {
+		return "", err
+	}
+	if len(frame) < sha256.Size {
+		return "", errors.New("backplane: malformed handshake")
+	}
+	mac, id := frame[:sha256.Size], frame[sha256.Size:]
+	if !hmac.Equal(mac, b.mac(tcpRoleAcceptor, ours, id)) {
+		return "", errors.New("backplane: node does not know the shared secret")
+	}
+	return string(id), nil
+}
+
+// mac returns the HMAC of the role, challenge and node ID with the shared secret.
+func (b *TCPBackplane) mac(role byte, challenge, nodeID []byte) []byte {
+	h := hmac.New(sha256.New, b.secret)
+	h.Write([]byte{role})
+	h.Write(challenge)
+	h.Write(nodeID)
+	return h.Sum(nil)
+}
+
+// newChallenge returns a random handshake challenge.
+func newChallenge() ([]byte, error) {
+	challenge := make([]byte, sha256.Size)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// peerByID returns the outgoing connection to the node with the given ID, or nil if there is none.
+func (b *TCPBackplane) peerByID(nodeID string) *tcpPeer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, p := range b.outbound {
+		if p.nodeID == nodeID {
+			return p
+		}
+	}
+	return nil
+}
+
+// write writes the message to the outgoing connection. Failed connections are closed to be reconnected in the background.
+func (b *TCPBackplane) write(p *tcpPeer, data []byte) error {
+	p.mutex.Lock()
+	p.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	err := writeFrame(p.conn, data)
+	p.mutex.Unlock()
+	if err != nil {
+		p.conn.Close()
+	}
+	return err
+}
+
+func (b *TCPBackplane) isClosed() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.closed
+}
+
+// writeFrame writes the data prefixed with its length as a 32 bit big endian integer.
+func writeFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame, which should not be larger than the given size.
+// Handshake frames are limited to a small size, as they are read before the other node is authenticated.
+func readFrame(r io.Reader, max uint32) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > max {
+		return nil, fmt.Errorf("backplane: frame size %v exceeds the limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
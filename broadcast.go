@@ -0,0 +1,137 @@
+package neptulon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// BroadcastResult is the aggregate result of a request sent to multiple client connections.
+type BroadcastResult struct {
+	Responses map[string]*ResCtx // conn ID -> response, including error responses for timed out or canceled requests
+	Errors    map[string]error   // conn ID -> error, for connections that the request could not be sent through
+}
+
+// Broadcast sends a JSON-RPC notification to all client connections.
+// If the server is connected to a backplane, the notification is sent to the connections on all the nodes,
+// even if sending through some of the connections on this server fails. See Multicast for details.
+func (s *Server) Broadcast(method string, params interface{}) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+
+	err := s.Multicast(nil, method, params)
+	if s.backplane != nil {
+		raw, merr := json.Marshal(params)
+		if merr != nil {
+			return merr
+		}
+		if berr := s.sendBackplane("", &backplaneMessage{Type: bpBroadcast, Method: method, Params: raw}); berr != nil && err == nil {
+			err = berr
+		}
+	}
+	return err
+}
+
+// Multicast sends a JSON-RPC notification to the client connections for which the filter returns true.
+// Filter can inspect the connection and its session, i.e. c.Session.Get("userid"). Nil filter matches all connections.
+// Only the connections on this server are matched, even if the server is connected to a backplane.
+// Notification is sent to all the matching connections even if sending through some of them fails,
+// in which case an error denoting the number of failed connections is returned.
+func (s *Server) Multicast(filter func(c *Conn) bool, method string, params interface{}) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+
+	return notifyAll(s.connsWhere(filter), method, params)
+}
+
+// BroadcastRequest sends a JSON-RPC request to all client connections and collects their responses.
+// See MulticastRequest for details.
+func (s *Server) BroadcastRequest(ctx context.Context, method string, params interface{}) (*BroadcastResult, error) {
+	return s.MulticastRequest(ctx, nil, method, params)
+}
+
+// MulticastRequest sends a JSON-RPC request to the client connections for which the filter returns true,
+// and blocks until a response is returned from each connection, or the request is otherwise completed.
+// If the context is done, or the response timeout of a connection passes before a response is returned,
+// the response is an ErrCodeCanceled or ErrCodeTimeout error response, same as with Conn.SendRequestContext.
+// Connections that are closed before returning a response yield error responses as well. Nil filter matches all connections.
+func (s *Server) MulticastRequest(ctx context.Context, filter func(c *Conn) bool, method string, params interface{}) (*BroadcastResult, error) {
+	if !s.running.Load().(bool) {
+		return nil, errors.New("use of closed server")
+	}
+
+	return requestAll(ctx, s.connsWhere(filter), method, params), nil
+}
+
+// connsWhere returns the client connections for which the filter returns true. Nil filter matches all connections.
+func (s *Server) connsWhere(filter func(c *Conn) bool) []*Conn {
+	var conns []*Conn
+	s.conns.Range(func(c interface{}) {
+		if filter == nil || filter(c.(*Conn)) {
+			conns = append(conns, c.(*Conn))
+		}
+	})
+	return conns
+}
+
+// notifyAll sends a JSON-RPC notification through all the given connections, and returns an error denoting the number of failed connections, if any.
+func notifyAll(conns []*Conn, method string, params interface{}) error {
+	var failed int
+	var firstErr error
+	for _, err := range notifyEach(conns, method, params) {
+		if err != nil {
+			if failed++; firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("server: failed to send notification to %v of %v connections: %v", failed, len(conns), firstErr)
+	}
+	return nil
+}
+
+// notifyEach sends a JSON-RPC notification through all the given connections, and returns the send error for each connection by connection ID.
+func notifyEach(conns []*Conn, method string, params interface{}) map[string]error {
+	errs := make(map[string]error, len(conns))
+	for _, c := range conns {
+		err := c.SendNotification(method, params)
+		if err != nil {
+			log.Printf("server: error sending notification %v: %v, method: %v, err: %v", c.ID, c.RemoteAddr(), method, err)
+		}
+		errs[c.ID] = err
+	}
+	return errs
+}
+
+// requestAll sends a JSON-RPC request through all the given connections and blocks until all the requests are completed.
+func requestAll(ctx context.Context, conns []*Conn, method string, params interface{}) *BroadcastResult {
+	res := &BroadcastResult{Responses: make(map[string]*ResCtx), Errors: make(map[string]error)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		_, err := c.SendRequestContext(ctx, method, params, func(rctx *ResCtx) error {
+			mutex.Lock()
+			res.Responses[rctx.Conn.ID] = rctx
+			mutex.Unlock()
+			wg.Done()
+			return nil
+		})
+		if err != nil {
+			wg.Done()
+			mutex.Lock()
+			res.Errors[c.ID] = err
+			mutex.Unlock()
+		}
+	}
+
+	wg.Wait()
+	return res
+}
@@ -0,0 +1,316 @@
+package neptulon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// cborCodec encodes messages in CBOR. []byte values are encoded as byte strings, and tags are ignored.
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return "cbor" }
+func (cborCodec) Binary() bool { return true }
+
+func (c cborCodec) Marshal(v interface{}) ([]byte, error)      { return marshalBinary(c, v) }
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return unmarshalBinary(c, data, v) }
+
+func (cborCodec) encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cborCodec) decodeValue(data []byte) (interface{}, error) {
+	d := cborDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: trailing data after cbor value", errDecode)
+	}
+	return v, nil
+}
+
+// CBOR major types.
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+// encodeCBOR encodes a generic value.
+func encodeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple | 22)
+	case bool:
+		if v {
+			buf.WriteByte(cborSimple | 21)
+		} else {
+			buf.WriteByte(cborSimple | 20)
+		}
+	case json.Number:
+		n, err := numberValue(v)
+		if err != nil {
+			return err
+		}
+		return encodeCBOR(buf, n)
+	case int64:
+		if v >= 0 {
+			encodeCBORHeader(buf, cborUint, uint64(v))
+		} else {
+			encodeCBORHeader(buf, cborNegint, uint64(-1-v))
+		}
+	case uint64:
+		encodeCBORHeader(buf, cborUint, v)
+	case float64:
+		buf.WriteByte(cborSimple | 27)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		encodeCBORHeader(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []byte:
+		encodeCBORHeader(buf, cborBytes, uint64(len(v)))
+		buf.Write(v)
+	case []interface{}:
+		encodeCBORHeader(buf, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := encodeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeCBORHeader(buf, cborMap, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			encodeCBOR(buf, k)
+			if err := encodeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as cbor", v)
+	}
+	return nil
+}
+
+// encodeCBORHeader encodes the major type and the argument (value or length) in the most compact form.
+func encodeCBORHeader(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// cborDecoder decodes CBOR values into generic values.
+type cborDecoder struct {
+	data  []byte
+	pos   int
+	depth int // nesting depth of the item being decoded
+}
+
+// cborBreak is returned by decodeItem when the break stop code of an indefinite length item is read.
+type cborBreak struct{}
+
+// next returns the next n bytes.
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end of cbor data", errDecode)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) decode() (interface{}, error) {
+	v, err := d.decodeItem()
+	if _, ok := v.(cborBreak); ok {
+		return nil, fmt.Errorf("%w: unexpected cbor break code", errDecode)
+	}
+	return v, err
+}
+
+// header reads the major type, the additional information and the argument of the next item.
+// Additional information of 31 denotes indefinite length (or the break code for major type 7), with a zero argument.
+func (d *cborDecoder) header() (major, info byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	major, info = b[0]&0xe0, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		b, err := d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, nil
+	case info == 31 && major != cborUint && major != cborNegint && major != cborTag:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("%w: invalid cbor additional information %v", errDecode, info)
+}
+
+// decodeItem decodes the next item, which might be the break code of an enclosing indefinite length item.
+func (d *cborDecoder) decodeItem() (interface{}, error) {
+	if d.depth++; d.depth > maxDecodeDepth {
+		return nil, fmt.Errorf("%w: cbor nesting depth exceeds %v", errDecode, maxDecodeDepth)
+	}
+	defer func() { d.depth-- }()
+
+	major, info, arg, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == 31
+
+	switch major {
+	case cborUint:
+		return arg, nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		var b []byte
+		if !indefinite {
+			if b, err = d.next(arg); err != nil {
+				return nil, err
+			}
+		} else {
+			// indefinite length strings are a sequence of definite length chunks of the same type, terminated by a break code
+			for {
+				chunk, err := d.decodeItem()
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := chunk.(cborBreak); ok {
+					break
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					b = append(b, c...)
+				case string:
+					b = append(b, c...)
+				default:
+					return nil, fmt.Errorf("%w: invalid cbor string chunk", errDecode)
+				}
+			}
+		}
+		if major == cborText {
+			return string(b), nil
+		}
+		return b, nil
+	case cborArray:
+		a := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			v, err := d.decodeItem()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(cborBreak); ok {
+				if !indefinite {
+					return nil, fmt.Errorf("%w: unexpected cbor break code", errDecode)
+				}
+				break
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case cborMap:
+		m := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := d.decodeItem()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := k.(cborBreak); ok {
+				if !indefinite {
+					return nil, fmt.Errorf("%w: unexpected cbor break code", errDecode)
+				}
+				break
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: cbor map keys must be strings", errDecode)
+			}
+			if m[ks], err = d.decode(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		// tags only carry semantic information about the enclosed item, which we do not make use of
+		return d.decode()
+	}
+
+	// major type 7: simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		return halfToFloat64(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case 31:
+		return cborBreak{}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported cbor simple value %v", errDecode, arg)
+}
+
+// halfToFloat64 converts an IEEE 754 half precision float into float64.
+func halfToFloat64(h uint16) float64 {
+	sign, exp, frac := h>>15, int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if sign != 0 {
+		f = -f
+	}
+	return f
+}
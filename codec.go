@@ -0,0 +1,115 @@
+package neptulon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Codec encodes and decodes messages in the wire format sent over the connection.
+// Messages follow the JSON-RPC data model, so Marshal and Unmarshal should handle Go values the same way as encoding/json does,
+// including struct tags and json.Marshaler and json.Unmarshaler implementations. Request params, response results and stream chunks
+// are kept in the wire format until they are read, so binary codecs send []byte values as binary data instead of base64 encoded strings.
+type Codec interface {
+	// Name returns the short codec name, i.e. "json" or "msgpack".
+	Name() string
+
+	// Binary returns true if messages should be sent as binary WebSocket frames instead of text frames.
+	Binary() bool
+
+	// Marshal encodes the value in the wire format.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the data in the wire format into the value, which should be a non-nil pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codecs.
+var (
+	JSONCodec    Codec = jsonCodec{}    // JSON over text frames. This is the default codec.
+	MsgPackCodec Codec = msgpackCodec{} // MessagePack over binary frames.
+	CBORCodec    Codec = cborCodec{}    // CBOR (RFC 7049) over binary frames.
+)
+
+// SubprotocolPrefix is the prefix of the WebSocket subprotocol names for the codecs, followed by the codec name (i.e. "jsonrpc.json").
+const SubprotocolPrefix = "jsonrpc."
+
+// subprotocol returns the WebSocket subprotocol name for the codec.
+func subprotocol(codec Codec) string {
+	return SubprotocolPrefix + codec.Name()
+}
+
+// codecBySubprotocol returns the codec among the given codecs which corresponds to the WebSocket subprotocol, or nil if there is none.
+func codecBySubprotocol(codecs []Codec, protocol string) Codec {
+	for _, c := range codecs {
+		if subprotocol(c) == protocol {
+			return c
+		}
+	}
+	return nil
+}
+
+// codecValue wraps a codec to be stored in an atomic.Value, which requires values of the same concrete type.
+type codecValue struct {
+	Codec
+}
+
+// jsonCodec uses encoding/json.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Binary() bool                               { return false }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// errDecode is the base error for messages that cannot be decoded by a binary codec.
+var errDecode = errors.New("codec: malformed message")
+
+// maxDecodeDepth is the maximum nesting depth of arrays and maps that binary codecs encode and decode, which is the same as encoding/json.
+const maxDecodeDepth = 10000
+
+// isSyntaxError checks if the decoding error denotes malformed data, as opposed to data of unexpected types.
+func isSyntaxError(err error) bool {
+	var serr *json.SyntaxError
+	return errors.As(err, &serr) || errors.Is(err, errDecode)
+}
+
+// decodeJSONValue decodes JSON into a generic value to be encoded by a binary codec.
+// Objects are decoded into map[string]interface{}, arrays into []interface{}, and numbers into json.Number.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// sortedKeys returns the keys of the object in sorted order, so that binary encodings are deterministic.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// numberValue converts a JSON number into the narrowest of int64, uint64 or float64 that can represent it.
+func numberValue(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u, nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("codec: invalid number %v: %v", n, err)
+	}
+	return f, nil
+}
@@ -1,12 +1,15 @@
 package neptulon
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -22,18 +25,69 @@ var recvCounter = expvar.NewInt("receivers")
 var reqCounter = expvar.NewInt("requests")
 var resCounter = expvar.NewInt("responses")
 
+// DefaultSendQueueSize is the default outbound message queue size for connections.
+const DefaultSendQueueSize = 256
+
+// DefaultMaxMessageSize is the default maximum size of incoming messages in bytes, in the wire format of the codec in use.
+const DefaultMaxMessageSize = 32 << 20
+
+// ErrSendQueueFull is returned when a message cannot be sent since the outbound message queue of the connection is full.
+var ErrSendQueueFull = errors.New("conn: outbound message queue is full")
+
 // Conn is a client connection.
 type Conn struct {
 	ID             string     // Randomly generated unique client connection ID.
 	Session        *cmap.CMap // Thread-safe data store for storing arbitrary data for this connection session.
 	middleware     []func(ctx *ReqCtx) error
-	resRoutes      *cmap.CMap     // message ID (string) -> handler func(ctx *ResCtx) error : expected responses for requests that we've sent
-	ws             atomic.Value   // -> *websocket.Conn
-	wg             sync.WaitGroup // incremented by one per goroutine created by conn
-	deadline       time.Duration
+	resRoutes      *cmap.CMap      // message ID (string) -> *pendingReq : expected responses for requests that we've sent
+	reqCancels     *cmap.CMap      // message ID (string) -> context.CancelCauseFunc : in-flight requests that we've received
+	reqStreams     *cmap.CMap      // message ID (string) -> *streamCredits : chunks that the peer allows for streaming requests that we've received, or are about to
+	streams        *cmap.CMap      // message ID (string) -> *Stream : streaming requests that we've sent
+	answered       *cmap.CMap      // message ID (string) -> bool : requests that we've answered while suspended, which the peer might send again upon resumption
+	ws             atomic.Value    // -> *websocket.Conn
+	out            chan []byte     // outbound message queue, drained by the writer goroutine
+	limiter        *limiter        // concurrency limit for handling requests from this connection
+	srvLimiter     *limiter        // server-wide concurrency limit shared by all connections of a server
+	storedSent     map[string]bool // IDs of the stored requests (see Server.DeliverToUser) sent through the connection and not answered yet
+	storedMutex    sync.Mutex
+	orderKey       func(ctx *ReqCtx) string
+	serial         *serializer     // runs requests sharing the same order key in arrival order
+	wg             sync.WaitGroup  // incremented by one per goroutine created by conn
+	ctx            context.Context // canceled when the underlying connection is closed
+	cancel         context.CancelFunc
+	ctxMutex       sync.Mutex
+	closed         chan struct{} // closed when the connection is closed for good with Close
+	closeOnce      sync.Once
+	pingInterval   time.Duration
+	idleTimeout    time.Duration
+	reqTimeout     time.Duration
+	resTimeout     time.Duration
+	streamWindow   int
+	maxMsgSize     int
+	strict         bool
+	codec          atomic.Value // -> codecValue : codec in use
+	codecs         []Codec      // codecs to request from the server in order of preference, for client connections
 	isClientConn   bool
-	connected      atomic.Value // -> bool
+	addr           string        // server address for client connections
+	backoff        *Backoff      // reconnection backoff for client connections, nil if reconnection is disabled
+	connected      atomic.Value  // -> bool
+	draining       atomic.Bool   // set when the server is shutting down, after which incoming requests are rejected
+	inflight       atomic.Int64  // number of incoming requests that are being handled, including sending their responses
+	queued         atomic.Int64  // number of outgoing messages queued but not yet written
+	seq            atomic.Uint64 // sequence number of the last request sent, to replay pending requests in order
+	resumable      bool          // set by the server for connections that are suspended instead of closed when lost
+	suspended      atomic.Bool   // set while a lost connection is waiting to be resumed
+	suspendSeq     uint64        // sequence number of the last request sent before the connection was suspended, or lost for client connections
+	missed         [][]byte      // messages sent while the connection was suspended, to be sent upon resumption
+	missedMutex    sync.Mutex
+	resumeToken    atomic.Value  // -> string : token to resume the session with, issued by the server
+	awaitSession   atomic.Bool   // set while the pending requests of a reconnected client connection wait for its session to be resumed
+	disconn        disconnReason // reason of the last disconnection
+	disconnMutex   sync.Mutex
 	disconnHandler func(c *Conn)
+	reconnHandler  func(c *Conn) error
+	stateHandler   func(c *Conn, state ConnState)
+	eventHandler   func(e *Event)
 }
 
 // NewConn creates a new Conn object.
@@ -47,17 +101,142 @@ func NewConn() (*Conn, error) {
 		ID:             id,
 		Session:        cmap.New(),
 		resRoutes:      cmap.New(),
-		deadline:       time.Second * time.Duration(300),
+		reqCancels:     cmap.New(),
+		reqStreams:     cmap.New(),
+		streams:        cmap.New(),
+		answered:       cmap.New(),
+		streamWindow:   DefaultStreamWindow,
+		maxMsgSize:     DefaultMaxMessageSize,
+		out:            make(chan []byte, DefaultSendQueueSize),
+		codecs:         []Codec{JSONCodec},
+		serial:         newSerializer(),
+		closed:         make(chan struct{}),
+		pingInterval:   DefaultPingInterval,
+		idleTimeout:    DefaultIdleTimeout,
 		disconnHandler: func(c *Conn) {},
+		reconnHandler:  func(c *Conn) error { return nil },
+		stateHandler:   func(c *Conn, state ConnState) {},
+		eventHandler:   func(e *Event) {},
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.codec.Store(codecValue{JSONCodec})
 	c.connected.Store(false)
 	return c, nil
 }
 
-// SetDeadline set the read/write deadlines for the connection, in seconds.
-// Default value for read/write deadline is 300 seconds.
+// SetDeadline sets the idle timeout for the connection, in seconds.
+//
+// Deprecated: Use SetIdleTimeout instead.
 func (c *Conn) SetDeadline(seconds int) {
-	c.deadline = time.Second * time.Duration(seconds)
+	c.SetIdleTimeout(time.Second * time.Duration(seconds))
+}
+
+// SetPingInterval sets the interval between WebSocket pings sent through the connection, to keep it alive and to detect unresponsive peers.
+// Peers respond to pings with pongs automatically. Zero value disables pings. Default value is DefaultPingInterval.
+// This should be called before connecting.
+func (c *Conn) SetPingInterval(interval time.Duration) {
+	c.pingInterval = interval
+}
+
+// SetIdleTimeout sets the duration after which the connection is closed if nothing is received from the peer, including pongs.
+// The same duration is used as the write deadline for each outgoing message. Zero value means no timeout.
+// Idle timeout should be longer than the ping interval of the connection. Default value is DefaultIdleTimeout.
+// This should be called before connecting.
+func (c *Conn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// SetSendQueueSize sets the outbound message queue size for the connection.
+// All outgoing messages are queued and written to the connection by a dedicated writer goroutine, one at a time.
+// Sending a message fails with ErrSendQueueFull when the queue is full, except for responses to incoming requests,
+// which wait for room in the queue so that peers sending requests faster than they read the responses are slowed down.
+// Size should be at least 1. This should be called before connecting. Default queue size is DefaultSendQueueSize.
+func (c *Conn) SetSendQueueSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("conn: send queue size must be at least 1, got: %v", size)
+	}
+	c.out = make(chan []byte, size)
+	return nil
+}
+
+// SetMaxMessageSize sets the maximum size of incoming messages in bytes, in the wire format of the codec in use.
+// Connection is closed with DisconnProtocolError if the peer sends a larger message.
+// This should be called before connecting. Default value is DefaultMaxMessageSize.
+func (c *Conn) SetMaxMessageSize(size int) {
+	c.maxMsgSize = size
+}
+
+// SetConcurrency limits the number of incoming requests that are handled concurrently for this connection.
+// Policy determines what happens to further incoming requests once the limit is reached.
+// Responses to our own requests are not subject to the limit, as they are bounded by the number of requests we send.
+// Note that with SaturationBlock, request handlers waiting on responses to their own requests through this connection
+// will deadlock if all the handlers are doing so, since responses cannot be read either.
+// This should be called before connecting. Zero limit (default) means no limit.
+func (c *Conn) SetConcurrency(limit int, policy SaturationPolicy) {
+	c.limiter = newLimiter(limit, policy)
+}
+
+// SetOrdered makes the connection handle incoming requests strictly in arrival order, one at a time.
+// Responses are also sent in the same order.
+func (c *Conn) SetOrdered(ordered bool) {
+	if ordered {
+		c.orderKey = orderAll
+	} else {
+		c.orderKey = nil
+	}
+}
+
+// SetOrderKey makes the connection handle incoming requests that share the same order key strictly in arrival order, one at a time,
+// while requests with different keys are still handled concurrently. Order key of each request is returned by keyFn.
+// Requests for which keyFn returns an empty string are not ordered. See OrderByMethod for a per-method ordering key function.
+func (c *Conn) SetOrderKey(keyFn func(ctx *ReqCtx) string) {
+	c.orderKey = keyFn
+}
+
+// SetRequestTimeout sets the duration after which the context of an incoming request is canceled.
+// Middleware can observe this through ReqCtx.Context(). Zero value (default) means no timeout.
+func (c *Conn) SetRequestTimeout(timeout time.Duration) {
+	c.reqTimeout = timeout
+}
+
+// SetResponseTimeout sets the default duration to wait for a response to a request sent through the connection.
+// If no response is received in time, the response handler is called with an ErrCodeTimeout error response.
+// Zero value (default) means no timeout.
+func (c *Conn) SetResponseTimeout(timeout time.Duration) {
+	c.resTimeout = timeout
+}
+
+// SetStrict enables or disables strict JSON-RPC 2.0 mode.
+// In strict mode, incoming messages without the "jsonrpc":"2.0" member or otherwise malformed messages
+// are answered with standard -32700 (parse error) or -32600 (invalid request) error responses,
+// instead of closing the connection. Strict mode is disabled by default.
+func (c *Conn) SetStrict(strict bool) {
+	c.strict = strict
+}
+
+// SetCodec sets the codec used to encode and decode messages sent through the connection, which is JSONCodec by default.
+// Client connections request the codec from the server with the corresponding WebSocket subprotocol (i.e. "jsonrpc.msgpack").
+// This should be called before connecting.
+func (c *Conn) SetCodec(codec Codec) {
+	c.SetCodecs(codec)
+}
+
+// SetCodecs sets the codecs that client connections request from the server with the corresponding WebSocket subprotocols,
+// in order of preference. The codec picked by the server is used for the connection.
+// If the server does not pick any of the subprotocols, the first codec is used. This should be called before connecting.
+// Returns an error if no codecs are given.
+func (c *Conn) SetCodecs(codecs ...Codec) error {
+	if len(codecs) == 0 {
+		return errors.New("conn: at least one codec must be given")
+	}
+	c.codecs = codecs
+	c.codec.Store(codecValue{codecs[0]})
+	return nil
+}
+
+// Codec returns the codec in use by the connection.
+func (c *Conn) Codec() Codec {
+	return c.codec.Load().(codecValue).Codec
 }
 
 // Middleware registers middleware to handle incoming request messages.
@@ -73,6 +252,7 @@ func (c *Conn) MiddlewareFunc(middleware ...func(ctx *ReqCtx) error) {
 }
 
 // DisconnHandler registers a function to handle disconnection event.
+// Disconnection reason is available through DisconnReason and Err.
 func (c *Conn) DisconnHandler(handler func(c *Conn)) {
 	c.disconnHandler = handler
 }
@@ -80,15 +260,17 @@ func (c *Conn) DisconnHandler(handler func(c *Conn)) {
 // Connect connects to the given WebSocket server.
 // addr should be formatted as ws://host:port -or- wss://host:port (i.e. ws://127.0.0.1:3000 -or- wss://localhost:3000)
 func (c *Conn) Connect(addr string) error {
-	ws, err := websocket.Dial(addr, "", "http://localhost")
+	c.addr = addr
+	ws, ac, err := c.dial()
 	if err != nil {
 		return err
 	}
-	if err := c.setConn(ws); err != nil {
+	if err := c.setConn(ws, ac); err != nil {
 		return err
 	}
 
 	c.isClientConn = true
+	c.stateHandler(c, StateConnected)
 	c.wg.Add(1)
 	go func() {
 		defer recoverAndLog(c, &c.wg)
@@ -98,6 +280,14 @@ func (c *Conn) Connect(addr string) error {
 	return nil
 }
 
+// Context returns the connection context, which is canceled when the connection is closed.
+// For reconnecting client connections, a new context is created upon each reconnection.
+func (c *Conn) Context() context.Context {
+	c.ctxMutex.Lock()
+	defer c.ctxMutex.Unlock()
+	return c.ctx
+}
+
 // RemoteAddr returns the remote network address.
 func (c *Conn) RemoteAddr() net.Addr {
 	ws := c.ws.Load().(*websocket.Conn)
@@ -111,36 +301,176 @@ func (c *Conn) RemoteAddr() net.Addr {
 // SendRequest sends a JSON-RPC request through the connection with an auto generated request ID.
 // resHandler is called when a response is returned.
 func (c *Conn) SendRequest(method string, params interface{}, resHandler func(res *ResCtx) error) (reqID string, err error) {
+	return c.SendRequestTimeout(method, params, c.resTimeout, resHandler)
+}
+
+// SendRequestTimeout sends a JSON-RPC request through the connection with an auto generated request ID.
+// resHandler is called when a response is returned, or with an ErrCodeTimeout error response if no response is returned within the given timeout.
+// Zero timeout means no timeout.
+func (c *Conn) SendRequestTimeout(method string, params interface{}, timeout time.Duration, resHandler func(res *ResCtx) error) (reqID string, err error) {
+	return c.sendRequest(context.Background(), method, params, timeout, resHandler)
+}
+
+// SendRequestContext sends a JSON-RPC request through the connection with an auto generated request ID.
+// resHandler is called when a response is returned. If the given context is canceled or its deadline passes before then,
+// the pending response is abandoned and resHandler is called with an ErrCodeCanceled or ErrCodeTimeout error response, respectively.
+// The same context is available to resHandler through ResCtx.Context().
+func (c *Conn) SendRequestContext(ctx context.Context, method string, params interface{}, resHandler func(res *ResCtx) error) (reqID string, err error) {
+	return c.sendRequest(ctx, method, params, c.resTimeout, resHandler)
+}
+
+func (c *Conn) sendRequest(ctx context.Context, method string, params interface{}, timeout time.Duration, resHandler func(res *ResCtx) error) (reqID string, err error) {
 	id, err := shortid.UUID()
 	if err != nil {
 		return "", err
 	}
-
-	req := request{ID: id, Method: method, Params: params}
-	if err = c.send(req); err != nil {
+	if err := c.sendRequestID(ctx, id, method, params, timeout, resHandler); err != nil {
 		return "", err
 	}
-
-	c.resRoutes.Set(req.ID, resHandler)
 	return id, nil
 }
 
+// sendRequestID sends the request with the given ID.
+func (c *Conn) sendRequestID(ctx context.Context, id string, method string, params interface{}, timeout time.Duration, resHandler func(res *ResCtx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// register response handler beforehand as response can arrive before send returns
+	req := request{JSONRPC: jsonrpcVersion, ID: id, Method: method, Params: params}
+	c.addPending(ctx, req, resHandler, timeout)
+	if err := c.send(req); err != nil {
+		c.removePending(id)
+		return err
+	}
+	return nil
+}
+
+// Call sends a JSON-RPC request through the connection and blocks until a response is returned or the context is done.
+// Response result is decoded into result, which should be passed by reference, unless it is nil.
+// If an error response is returned, the returned error is of type *CallError carrying the JSON-RPC error details.
+// If the context is done before a response is returned, the context error is returned.
+func (c *Conn) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	done := make(chan error, 1)
+	_, err := c.SendRequestContext(ctx, method, params, func(res *ResCtx) error {
+		if !res.Success {
+			done <- &CallError{Code: res.ErrorCode, Message: res.ErrorMessage, Data: res.errorData}
+			return nil
+		}
+		if result != nil {
+			done <- res.Result(result)
+			return nil
+		}
+		done <- nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // SendRequestArr sends a JSON-RPC request through the connection, with array params and auto generated request ID.
 // resHandler is called when a response is returned.
 func (c *Conn) SendRequestArr(method string, resHandler func(res *ResCtx) error, params ...interface{}) (reqID string, err error) {
 	return c.SendRequest(method, params, resHandler)
 }
 
-// Close closes the connection.
+// SendNotification sends a JSON-RPC notification through the connection.
+// Notifications are requests without an ID so the peer never returns a response for them.
+func (c *Conn) SendNotification(method string, params interface{}) error {
+	return c.send(request{JSONRPC: jsonrpcVersion, Method: method, Params: params})
+}
+
+// SendNotificationArr sends a JSON-RPC notification through the connection, with array params.
+func (c *Conn) SendNotificationArr(method string, params ...interface{}) error {
+	return c.SendNotification(method, params)
+}
+
+// SendBatch sends a batch of JSON-RPC requests and/or notifications through the connection in a single message, with auto generated request IDs.
+// Each request's response handler is called as its response is returned.
+// Returned request IDs are in the same order as the given requests, with empty IDs for notifications.
+func (c *Conn) SendBatch(reqs ...BatchRequest) (reqIDs []string, err error) {
+	if len(reqs) == 0 {
+		return nil, errors.New("conn: batch cannot be empty")
+	}
+
+	batch := make([]request, len(reqs))
+	reqIDs = make([]string, len(reqs))
+	for i, r := range reqs {
+		batch[i] = request{JSONRPC: jsonrpcVersion, Method: r.Method, Params: r.Params}
+		if r.ResHandler == nil {
+			continue
+		}
+
+		if reqIDs[i], err = shortid.UUID(); err != nil {
+			return nil, err
+		}
+		batch[i].ID = reqIDs[i]
+	}
+
+	// register response handlers beforehand as responses can arrive before send returns
+	for i, id := range reqIDs {
+		if id != "" {
+			c.addPending(context.Background(), batch[i], reqs[i].ResHandler, c.resTimeout)
+		}
+	}
+
+	if err := c.send(batch); err != nil {
+		for _, id := range reqIDs {
+			if id != "" {
+				c.removePending(id)
+			}
+		}
+		return nil, err
+	}
+
+	return reqIDs, nil
+}
+
+// Close closes the connection. Reconnecting client connections do not reconnect after being closed with Close.
 func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.setReason(DisconnLocalClose, nil)
+	return c.disconnect()
+}
+
+// disconnect closes the underlying WebSocket connection and cancels the connection context.
+func (c *Conn) disconnect() error {
 	c.connected.Store(false)
-	ws := c.ws.Load().(*websocket.Conn)
-	if ws != nil {
+	c.ctxMutex.Lock()
+	c.cancel()
+	c.ctxMutex.Unlock()
+	if ws, _ := c.ws.Load().(*websocket.Conn); ws != nil {
 		ws.Close()
 	}
 	return nil
 }
 
+// drain stops handling new incoming requests, and waits for the in-flight requests to be handled and all queued messages to be written.
+// Returns the context error if the context is done before then.
+func (c *Conn) drain(ctx context.Context) error {
+	c.draining.Store(true)
+	t := time.NewTicker(time.Millisecond * 10)
+	defer t.Stop()
+	for c.inflight.Load() > 0 || c.queued.Load() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
 // Wait waits for all message/connection handler goroutines to exit.
 // Returns error if wait timeouts (in seconds).
 func (c *Conn) Wait(timeout int) error {
@@ -156,122 +486,831 @@ func (c *Conn) Wait(timeout int) error {
 	}
 }
 
-// SendResponse sends a JSON-RPC response message through the connection.
-func (c *Conn) sendResponse(id string, result interface{}, err *ResError) error {
-	return c.send(response{ID: id, Result: result, Error: err})
+// Send queues the given message to be sent through the connection.
+// If the connection is suspended, message is kept to be sent once the connection is resumed.
+func (c *Conn) send(msg interface{}) error {
+	return c.sendMsg(msg, false)
 }
 
-// Send sends the given message through the connection.
-func (c *Conn) send(msg interface{}) error {
+// sendWait queues the given message like send, but waits for room in the outbound message queue instead of failing with
+// ErrSendQueueFull, until the connection is closed. Responses are sent this way, so that request handlers are slowed down
+// to the pace of the peer instead of the peer being disconnected.
+func (c *Conn) sendWait(msg interface{}) error {
+	return c.sendMsg(msg, true)
+}
+
+func (c *Conn) sendMsg(msg interface{}, wait bool) error {
+	if !c.connected.Load().(bool) && !c.suspended.Load() {
+		return errors.New("use of closed connection")
+	}
+
+	data, err := c.Codec().Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if c.suspended.Load() {
+		if ok, err := c.addMissed(data); ok {
+			return err
+		}
+	}
 	if !c.connected.Load().(bool) {
 		return errors.New("use of closed connection")
 	}
+	return c.enqueue(data, wait)
+}
+
+// enqueue queues the message encoded with the codec of the connection to be sent.
+// If wait is true and the queue is full, it waits for room in the queue until the connection is closed.
+func (c *Conn) enqueue(data []byte, wait bool) error {
+	c.queued.Add(1)
+	select {
+	case c.out <- data:
+		return nil
+	default:
+	}
+	if !wait {
+		c.queued.Add(-1)
+		return ErrSendQueueFull
+	}
+
+	select {
+	case c.out <- data:
+		return nil
+	case <-c.Context().Done():
+		c.queued.Add(-1)
+		return errors.New("use of closed connection")
+	}
+}
+
+// startSend starts writing queued outgoing messages to the given connection, one at a time.
+// This method blocks and does not return until done is closed or a write fails.
+// WebSocket pings are also sent from here, at the ping interval of the connection.
+func (c *Conn) startSend(ws *websocket.Conn, done <-chan struct{}) {
+	var ping <-chan time.Time
+	if c.pingInterval > 0 {
+		t := time.NewTicker(c.pingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+
+	binary := c.Codec().Binary()
+	for {
+		var err error
+		select {
+		case data := <-c.out:
+			if err = c.setWriteDeadline(ws); err == nil {
+				if binary {
+					err = websocket.Message.Send(ws, data)
+				} else {
+					err = websocket.Message.Send(ws, string(data))
+				}
+			}
+			c.queued.Add(-1)
+		case <-ping:
+			if err = c.setWriteDeadline(ws); err == nil {
+				err = pingCodec.Send(ws, nil)
+			}
+		case <-done:
+			return
+		}
 
-	return websocket.JSON.Send(c.ws.Load().(*websocket.Conn), msg)
+		if err != nil {
+			// closing the underlying connection fails the receive loop, which takes care of the rest
+			log.Printf("conn: error while sending message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				c.setReason(DisconnDeadlineExceeded, err)
+			} else {
+				c.setReason(DisconnNetworkError, err)
+			}
+			ws.Close()
+			return
+		}
+	}
 }
 
-// Receive receives message from the connection.
-func (c *Conn) receive(msg *message) error {
+// setWriteDeadline sets the write deadline for the next outgoing frame, if the connection has an idle timeout.
+func (c *Conn) setWriteDeadline(ws *websocket.Conn) error {
+	if c.idleTimeout <= 0 {
+		return nil
+	}
+	return ws.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+}
+
+// Receive receives a single raw message frame from the connection.
+func (c *Conn) receive() ([]byte, error) {
 	if !c.connected.Load().(bool) {
-		return errors.New("use of closed connection")
+		return nil, errors.New("use of closed connection")
+	}
+
+	var data []byte
+	err := websocket.Message.Receive(c.ws.Load().(*websocket.Conn), &data)
+	return data, err
+}
+
+// dial opens a new WebSocket connection to the server address of the client connection,
+// and picks the codec for the connection according to the subprotocol picked by the server.
+func (c *Conn) dial() (*websocket.Conn, *activityConn, error) {
+	protocols := make([]string, len(c.codecs))
+	for i, codec := range c.codecs {
+		protocols[i] = subprotocol(codec)
+	}
+
+	header := make(http.Header)
+	if token := c.ResumeToken(); token != "" {
+		header.Set(ResumeHeader, token)
+	}
+
+	ws, ac, err := dialActivity(c.addr, "http://localhost", protocols, header)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return websocket.JSON.Receive(c.ws.Load().(*websocket.Conn), &msg)
+	codec := c.codecs[0]
+	if p := ws.Config().Protocol; len(p) == 1 {
+		if cd := codecBySubprotocol(c.codecs, p[0]); cd != nil {
+			codec = cd
+		}
+	}
+	c.codec.Store(codecValue{codec})
+	return ws, ac, nil
 }
 
 // Reuse an established websocket.Conn.
-func (c *Conn) setConn(ws *websocket.Conn) error {
+// If the underlying activityConn is given, read deadline of the connection is extended by the idle timeout upon every read.
+func (c *Conn) setConn(ws *websocket.Conn, ac *activityConn) error {
+	if c.idleTimeout > 0 {
+		if err := ws.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			ws.Close()
+			return fmt.Errorf("conn: error while setting websocket connection deadline: %v", err)
+		}
+		if ac != nil {
+			ac.idleTimeout = c.idleTimeout
+		}
+	}
+	ws.MaxPayloadBytes = c.maxMsgSize
+	c.resetReason()
+
+	c.ctxMutex.Lock()
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	done := c.ctx.Done()
+	c.ctxMutex.Unlock()
+
 	c.ws.Store(ws)
 	c.connected.Store(true)
-	if err := ws.SetDeadline(time.Now().Add(c.deadline)); err != nil {
-		return fmt.Errorf("conn: error while setting websocket connection deadline: %v", err)
-	}
+
+	c.wg.Add(1)
+	go func() {
+		defer recoverAndLog(c, &c.wg)
+		c.startSend(ws, done)
+	}()
+	c.eventHandler(&Event{Type: EventConnected, Conn: c})
 	return nil
 }
 
 // startReceive starts receiving messages. This method blocks and does not return until the connection is closed.
+// Reconnecting client connections redial the server when the connection is lost, and keep receiving messages.
+// Resumable connections are suspended instead when the connection is lost, and return without being closed.
 func (c *Conn) startReceive() {
 	recvCounter.Add(1)
 	defer func() {
-		c.Close()
-		c.disconnHandler(c)
+		if !c.suspended.Load() {
+			c.finish()
+		}
 		recvCounter.Add(-1)
 	}()
 
 	for {
-		var m message
-		err := c.receive(&m)
+		c.receiveLoop()
+		if reason := c.DisconnReason(); reason.lost() && c.resumable {
+			c.suspend()
+			c.eventHandler(&Event{Type: EventDisconnected, Conn: c, Reason: reason, Err: c.Err()})
+			return
+		}
+		c.disconnect()
+		e := &Event{Type: EventDisconnected, Conn: c, Reason: c.DisconnReason(), Err: c.Err()}
+		reconnect := e.Reason.lost() && c.isClientConn && c.backoff != nil
+		// pending requests are kept if the session might be resumed, until the server tells whether it is,
+		// and requests among the queued messages are sent again from the pending requests list upon resumption
+		if !reconnect || c.ResumeToken() == "" {
+			c.failAllPending(ErrCodeDisconnected, "Connection closed before a response was received.")
+		} else {
+			c.suspendSeq = c.seq.Load()
+			for _, data := range c.takeQueued() {
+				if err := c.enqueue(data, false); err != nil {
+					log.Printf("conn: error keeping queued message for reconnection %v: %v", c.ID, err)
+				}
+			}
+		}
+		c.eventHandler(e)
+		if !reconnect || !c.reconnect() {
+			c.awaitSession.Store(false)
+			c.failAllPending(ErrCodeDisconnected, "Connection closed before a response was received.")
+			return
+		}
+		c.awaitSession.Store(c.ResumeToken() != "")
+	}
+}
+
+// finish closes the connection for good. Pending requests of suspended connections fail with ErrCodeDisconnected.
+func (c *Conn) finish() {
+	if c.suspended.Swap(false) {
+		c.missedMutex.Lock()
+		c.missed = nil
+		c.missedMutex.Unlock()
+		c.failAllPending(ErrCodeDisconnected, "Connection closed before a response was received.")
+	}
+	c.Close()
+	c.stateHandler(c, StateDisconnected)
+	c.disconnHandler(c)
+}
+
+// receiveLoop receives and handles messages until the underlying connection is closed.
+// Disconnection reason is set before returning.
+func (c *Conn) receiveLoop() {
+	for {
+		data, err := c.receive()
 		if err != nil {
 			// if we closed the connection
 			if !c.connected.Load().(bool) {
 				log.Printf("conn: closed %v: %v", c.ID, c.RemoteAddr())
-				break
+				c.setReason(DisconnLocalClose, nil)
+				return
 			}
 
 			// if peer closed the connection
 			if err == io.EOF {
 				log.Printf("conn: peer disconnected %v: %v", c.ID, c.RemoteAddr())
-				break
+				c.setReason(DisconnPeerClosed, err)
+				return
+			}
+
+			// if peer sent a message larger than allowed
+			if err == websocket.ErrFrameTooLarge {
+				log.Printf("conn: peer sent a message larger than %v bytes %v: %v", c.maxMsgSize, c.ID, c.RemoteAddr())
+				c.setReason(DisconnProtocolError, err)
+				return
+			}
+
+			// if peer stopped responding
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				log.Printf("conn: peer did not respond within the idle timeout %v: %v", c.ID, c.RemoteAddr())
+				c.setReason(DisconnDeadlineExceeded, ErrIdleTimeout)
+				return
 			}
 
 			log.Printf("conn: error while receiving message: %v", err)
-			break
+			c.setReason(DisconnNetworkError, err)
+			return
+		}
+
+		// if the message is a batch of requests and/or responses
+		if isBatch(c.Codec(), data) {
+			c.failUnresumed()
+			if !c.handleBatch(data) {
+				return
+			}
+			continue
+		}
+
+		m, errRes, err := c.decodeMessage(data)
+		if err != nil {
+			log.Printf("conn: error while decoding message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+			c.setReason(DisconnProtocolError, err)
+			return
+		}
+
+		// in strict mode, reply to malformed messages with a JSON-RPC error instead of dropping the connection
+		if errRes != nil {
+			if err := c.sendWait(errRes); err != nil {
+				log.Printf("conn: error sending response: %v", err)
+				c.setReason(DisconnNetworkError, err)
+				return
+			}
+			continue
+		}
+
+		// first message after reconnecting is a session message if the server resumed the session
+		if m.Method != SessionMethod {
+			c.failUnresumed()
+		}
+
+		// if the message is a request cancellation
+		if m.Method == CancelRequestMethod {
+			c.handleCancel(m)
+			continue
+		}
+
+		// if the message is a stream chunk or acknowledgement
+		if m.Method == StreamMethod {
+			c.handleChunk(m)
+			continue
+		}
+		if m.Method == StreamAckMethod {
+			c.handleStreamAck(m)
+			continue
+		}
+
+		// if the message is a resume token from the server
+		if m.Method == SessionMethod && c.isClientConn {
+			c.handleSession(m)
+			continue
 		}
 
 		// if the message is a request
 		if m.Method != "" {
-			reqCounter.Add(1)
-			c.wg.Add(1)
-			go func() {
-				defer reqCounter.Add(-1)
-				defer recoverAndLog(c, &c.wg)
-				ctx := newReqCtx(c, m.ID, m.Method, m.Params, c.middleware)
-				if err := ctx.Next(); err != nil {
-					log.Printf("ctx: request middleware returned error: %v", err)
-					c.Close()
+			if c.isResent(m) {
+				log.Printf("conn: ignoring request that was sent again upon resumption %v: %v, %v", c.ID, c.RemoteAddr(), m.Method)
+				continue
+			}
+			ok := c.dispatchRequest(m, func(res *response) {
+				if res == nil {
+					return
 				}
-				if ctx.Res != nil || ctx.Err != nil {
-					if err := ctx.Conn.sendResponse(ctx.ID, ctx.Res, ctx.Err); err != nil {
-						log.Printf("ctx: error sending response: %v", err)
-						c.Close()
-					}
+				// sending only fails if the connection is closed meanwhile, or the response cannot be serialized
+				if err := c.sendWait(res); err != nil {
+					log.Printf("ctx: error sending response: %v", err)
 				}
-			}()
+			})
+			if !ok {
+				return
+			}
 
 			continue
 		}
 
+		// error responses to our own malformed messages carry a null ID
+		id := idString(m.ID)
+		if c.strict && id == "" && m.Error != nil {
+			log.Printf("conn: peer returned an error response for a malformed message %v: %v, %v: %v", c.ID, c.RemoteAddr(), m.Error.Code, m.Error.Message)
+			continue
+		}
+
 		// if the message is not a JSON-RPC message
-		if m.ID == "" || (m.Result == nil && m.Error == nil) {
-			log.Printf("conn: received an unknown message %v: %v, %v", c.ID, c.RemoteAddr(), m)
-			break
+		if id == "" || (m.Result.data == nil && m.Error == nil) {
+			log.Printf("conn: received an unknown message %v: %v, %s", c.ID, c.RemoteAddr(), data)
+			c.setReason(DisconnProtocolError, errUnknownMessage)
+			return
 		}
 
 		// if the message is a response
-		if resHandler, ok := c.resRoutes.GetOk(m.ID); ok {
-			resCounter.Add(1)
-			c.wg.Add(1)
-			go func() {
-				defer resCounter.Add(-1)
-				defer recoverAndLog(c, &c.wg)
-				err := resHandler.(func(ctx *ResCtx) error)(newResCtx(c, m.ID, m.Result, m.Error))
-				c.resRoutes.Delete(m.ID)
-				if err != nil {
-					log.Printf("conn: error while handling response: %v", err)
-					c.Close()
-				}
-			}()
-		} else {
-			log.Printf("conn: error while handling response: got response to a request with unknown ID: %v", m.ID)
-			break
+		c.handleResponse(id, m)
+	}
+}
+
+// Disconnection errors for protocol errors.
+var (
+	errUnknownMessage = errors.New("conn: received an unknown message")
+	errMalformedBatch = errors.New("conn: received a malformed batch message")
+)
+
+// decodeMessage decodes a single incoming JSON-RPC message.
+// In strict mode, malformed messages are not returned but an error response to be sent back to the peer is returned instead.
+func (c *Conn) decodeMessage(data []byte) (*message, *response, error) {
+	var m message
+	err := c.Codec().Unmarshal(data, &m)
+	if !c.strict {
+		return &m, nil, err
+	}
+
+	if resErr := checkMessage(&m, err); resErr != nil {
+		log.Printf("conn: received a malformed message %v: %v, %v: %s", c.ID, c.RemoteAddr(), resErr.Message, data)
+		id := m.ID
+		if !validID(id) || id == nil {
+			id = nullID
+		}
+		return nil, &response{JSONRPC: jsonrpcVersion, ID: id, Error: resErr}, nil
+	}
+
+	return &m, nil, nil
+}
+
+// dispatchRequest handles the incoming request in a new goroutine, subject to the connection and server concurrency limits.
+// Requests with an order key are handled after all the previous requests with the same key are handled.
+// done is called with the response to be sent back to the peer, if any.
+// If a limit is reached, depending on the saturation policy, dispatchRequest either blocks until the request can be handled,
+// calls done right away with an ErrCodeServerBusy error response, or returns false to indicate that the connection should be closed,
+// after setting the disconnection reason.
+func (c *Conn) dispatchRequest(m *message, done func(res *response)) bool {
+	// count the request as in-flight before checking the draining flag, so that drain does not miss it
+	c.inflight.Add(1)
+	if c.draining.Load() {
+		c.inflight.Add(-1)
+		log.Printf("conn: rejecting request since server is shutting down %v: %v, %v", c.ID, c.RemoteAddr(), m.Method)
+		if m.ID == nil {
+			done(nil)
+			return true
+		}
+		c.reqStreams.Delete(idString(m.ID))
+		done(&response{JSONRPC: jsonrpcVersion, ID: m.ID, Error: &ResError{Code: ErrCodeShuttingDown, Message: "Server is shutting down."}})
+		return true
+	}
+
+	policy := SaturationBlock
+	if !c.limiter.acquire() {
+		policy = c.limiter.policy
+	} else if !c.srvLimiter.acquire() {
+		c.limiter.release()
+		policy = c.srvLimiter.policy
+	} else {
+		ctx := c.newReqCtx(m)
+		c.wg.Add(1)
+		handle := func() {
+			defer recoverAndLog(c, &c.wg)
+			defer c.inflight.Add(-1)
+			defer c.limiter.release()
+			defer c.srvLimiter.release()
+			var res *response
+			defer func() { done(res) }()
+			res = c.handleRequest(ctx)
+		}
+
+		if c.orderKey != nil {
+			if key := c.orderKey(ctx); key != "" {
+				c.serial.run(key, handle)
+				return true
+			}
+		}
+		go handle()
+		return true
+	}
+
+	c.inflight.Add(-1)
+	if policy == SaturationClose {
+		log.Printf("conn: closing connection since concurrency limit is reached %v: %v", c.ID, c.RemoteAddr())
+		c.setReason(DisconnLimitReached, nil)
+		done(nil)
+		return false
+	}
+
+	log.Printf("conn: rejecting request since concurrency limit is reached %v: %v, %v", c.ID, c.RemoteAddr(), m.Method)
+	if m.ID == nil {
+		done(nil)
+		return true
+	}
+	c.reqStreams.Delete(idString(m.ID))
+	done(&response{JSONRPC: jsonrpcVersion, ID: m.ID, Error: &ResError{Code: ErrCodeServerBusy, Message: "Server is busy."}})
+	return true
+}
+
+// newReqCtx creates the context for an incoming request.
+// Requests with IDs are tracked until they are handled, so that they can be canceled by the peer.
+func (c *Conn) newReqCtx(m *message) *ReqCtx {
+	reqCtx, cancel := context.WithCancelCause(c.Context())
+	ctx := newReqCtx(reqCtx, c, m.ID, m.Method, m.Params, c.middleware)
+	ctx.cancel = cancel
+	if !ctx.notification {
+		c.reqCancels.Set(ctx.ID, cancel)
+		// stream window is opened before the request is sent, if the peer asks for a streaming response
+		if credits, ok := c.reqStreams.GetOk(ctx.ID); ok {
+			ctx.credits = credits.(*streamCredits)
+		}
+	}
+	return ctx
+}
+
+// handleRequest runs the incoming request through the middleware stack.
+// Returns the response to be sent back to the peer, if any.
+func (c *Conn) handleRequest(ctx *ReqCtx) *response {
+	reqCounter.Add(1)
+	defer reqCounter.Add(-1)
+
+	defer func() {
+		if !ctx.notification {
+			c.reqCancels.Delete(ctx.ID)
+			c.reqStreams.Delete(ctx.ID)
+		}
+		ctx.cancel(nil)
+	}()
+	if c.reqTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx.ctx, cancel = context.WithTimeout(ctx.ctx, c.reqTimeout)
+		defer cancel()
+	}
+
+	if err := ctx.Next(); err != nil {
+		log.Printf("ctx: request middleware returned error: %v", err)
+		c.closeWith(DisconnMiddlewareError, err)
+	}
+
+	// notifications never get a response, even if one was set by the middleware
+	if ctx.notification {
+		return nil
+	}
+
+	// let the peer know that we gave up on the request if it canceled it and the middleware did not return anything
+	if ctx.Res == nil && ctx.Err == nil {
+		if context.Cause(ctx.ctx) != errCanceledByPeer {
+			return nil
+		}
+		ctx.Err = &ResError{Code: ErrCodeCanceled, Message: "Request was canceled."}
+	}
+
+	id := ctx.rawID
+	if id == nil {
+		id = nullID
+	}
+	return &response{JSONRPC: jsonrpcVersion, ID: id, Result: ctx.Res, Error: ctx.Err}
+}
+
+// errCanceledByPeer is the cause of the context cancellation for requests canceled by the peer.
+var errCanceledByPeer = errors.New("conn: request was canceled by the peer")
+
+// handleCancel cancels the context of the in-flight request denoted by the incoming request cancellation message.
+func (c *Conn) handleCancel(m *message) {
+	var p cancelParams
+	if err := m.Params.unmarshal(&p); err != nil {
+		log.Printf("conn: received a malformed request cancellation message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		return
+	}
+
+	if cancel, ok := c.reqCancels.GetOk(idString(p.ID)); ok {
+		cancel.(context.CancelCauseFunc)(errCanceledByPeer)
+	} else {
+		// stream window might have been opened for a request that the peer failed to send
+		c.reqStreams.Delete(idString(p.ID))
+	}
+}
+
+// sendCancel lets the peer know that we are no longer interested in the response to the request with the given ID.
+func (c *Conn) sendCancel(id string) {
+	if !c.connected.Load().(bool) {
+		return
+	}
+
+	rawID, _ := json.Marshal(id)
+	if err := c.SendNotification(CancelRequestMethod, cancelParams{ID: rawID}); err != nil {
+		log.Printf("conn: error sending request cancellation message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+	}
+}
+
+// handleResponse asynchronously calls the response handler registered for the incoming response.
+// Responses to unknown requests are ignored, as they might be late responses to requests that we gave up on.
+func (c *Conn) handleResponse(id string, m *message) {
+	p, ok := c.resRoutes.GetOk(id)
+	if !ok {
+		log.Printf("conn: ignoring response to a request with unknown ID %v: %v, %v", c.ID, c.RemoteAddr(), id)
+		return
+	}
+
+	c.completePending(p.(*pendingReq), newResCtx(c, id, m.Result, m.Error))
+}
+
+// pendingReq is a request that we've sent and are expecting a response for.
+type pendingReq struct {
+	id      string
+	msg     request // sent again if the connection is resumed before a response is received
+	seq     uint64
+	ctx     context.Context
+	handler func(ctx *ResCtx) error
+	timer   *time.Timer
+	stop    func() bool // stops watching the request context
+	done    bool        // set once the request is completed with a response, timeout, or disconnection
+	mutex   sync.Mutex
+}
+
+// addPending registers a response handler for the request with the given ID.
+// If timeout is non-zero, the handler is called with an ErrCodeTimeout error response after the timeout.
+// If the context is done before a response is received, the handler is called with an ErrCodeCanceled or ErrCodeTimeout error response.
+// In both cases, the peer is sent a request cancellation message.
+func (c *Conn) addPending(ctx context.Context, req request, handler func(ctx *ResCtx) error, timeout time.Duration) {
+	id := req.ID
+	p := &pendingReq{id: id, msg: req, seq: c.seq.Add(1), ctx: ctx, handler: handler}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c.resRoutes.Set(id, p)
+	if timeout > 0 {
+		p.timer = time.AfterFunc(timeout, func() {
+			if c.completePending(p, newResCtx(c, id, rawValue{}, &resError{Code: ErrCodeTimeout, Message: "Response was not received in time."})) {
+				c.sendCancel(id)
+			}
+		})
+	}
+	if ctx.Done() != nil {
+		p.stop = context.AfterFunc(ctx, func() {
+			code, msg := ErrCodeCanceled, "Request was canceled."
+			if ctx.Err() == context.DeadlineExceeded {
+				code, msg = ErrCodeTimeout, "Response was not received before the context deadline."
+			}
+			if c.completePending(p, newResCtx(c, id, rawValue{}, &resError{Code: code, Message: msg})) {
+				c.sendCancel(id)
+			}
+		})
+	}
+}
+
+// removePending removes the response handler for the request with the given ID without calling it.
+func (c *Conn) removePending(id string) {
+	if p, ok := c.resRoutes.GetOk(id); ok {
+		p.(*pendingReq).complete()
+		c.resRoutes.Delete(id)
+	}
+}
+
+// completePending asynchronously calls the response handler of the pending request with the given response context,
+// and removes the request from the pending requests list.
+// Does nothing and returns false if the request was already completed (i.e. response arrived after the request timed out).
+func (c *Conn) completePending(p *pendingReq, ctx *ResCtx) bool {
+	if !p.complete() {
+		log.Printf("conn: ignoring response to an already completed request %v: %v, %v", c.ID, c.RemoteAddr(), p.id)
+		return false
+	}
+	c.resRoutes.Delete(p.id)
+	ctx.ctx = p.ctx
+
+	resCounter.Add(1)
+	c.wg.Add(1)
+	go func() {
+		defer resCounter.Add(-1)
+		defer recoverAndLog(c, &c.wg)
+		if err := p.handler(ctx); err != nil {
+			log.Printf("conn: error while handling response: %v", err)
+			c.closeWith(DisconnMiddlewareError, err)
+		}
+	}()
+	return true
+}
+
+// failAllPending completes all pending requests with a synthesized error response.
+func (c *Conn) failAllPending(code int, message string) {
+	var ps []*pendingReq
+	c.resRoutes.Range(func(p interface{}) {
+		ps = append(ps, p.(*pendingReq))
+	})
+
+	for _, p := range ps {
+		c.completePending(p, newResCtx(c, p.id, rawValue{}, &resError{Code: code, Message: message}))
+	}
+}
+
+// complete marks the pending request as completed and stops its timeout timer, if any.
+// Returns false if the request was already completed.
+func (p *pendingReq) complete() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.done {
+		return false
+	}
+	p.done = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if p.stop != nil {
+		p.stop()
+	}
+	return true
+}
+
+// handleBatch handles an incoming JSON-RPC batch message.
+// All the requests in the batch are handled concurrently and their responses are sent back in a single batch response.
+// Responses in the batch are routed to their respective response handlers.
+// Returns false if the connection should be closed, after setting the disconnection reason.
+func (c *Conn) handleBatch(data []byte) bool {
+	var msgs []rawValue
+	if err := c.Codec().Unmarshal(data, &msgs); err != nil || len(msgs) == 0 {
+		if !c.strict {
+			log.Printf("conn: received a malformed batch message %v: %v, %s", c.ID, c.RemoteAddr(), data)
+			c.setReason(DisconnProtocolError, errMalformedBatch)
+			return false
+		}
+
+		resErr := &ResError{Code: ErrCodeInvalidRequest, Message: "Invalid request: batch must be a non-empty array."}
+		if isSyntaxError(err) {
+			resErr = &ResError{Code: ErrCodeParse, Message: "Parse error."}
 		}
+		if err := c.sendWait(response{JSONRPC: jsonrpcVersion, ID: nullID, Error: resErr}); err != nil {
+			log.Printf("conn: error sending response: %v", err)
+			c.setReason(DisconnNetworkError, err)
+			return false
+		}
+		return true
 	}
+
+	var wg sync.WaitGroup
+	res := make([]*response, len(msgs))
+	for i, msg := range msgs {
+		m, errRes, err := c.decodeMessage(msg.data)
+		if err != nil {
+			log.Printf("conn: error while decoding batch message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+			c.setReason(DisconnProtocolError, err)
+			return false
+		}
+		if errRes != nil {
+			res[i] = errRes
+			continue
+		}
+
+		if m.Method == CancelRequestMethod {
+			c.handleCancel(m)
+			continue
+		}
+		if m.Method == StreamMethod {
+			c.handleChunk(m)
+			continue
+		}
+		if m.Method == StreamAckMethod {
+			c.handleStreamAck(m)
+			continue
+		}
+
+		if m.Method != "" {
+			i := i
+			wg.Add(1)
+			if !c.dispatchRequest(m, func(r *response) { res[i] = r; wg.Done() }) {
+				return false
+			}
+			continue
+		}
+
+		id := idString(m.ID)
+		if id == "" || (m.Result.data == nil && m.Error == nil) {
+			log.Printf("conn: received an unknown message in batch %v: %v, %s", c.ID, c.RemoteAddr(), msg.data)
+			c.setReason(DisconnProtocolError, errUnknownMessage)
+			return false
+		}
+		c.handleResponse(id, m)
+	}
+
+	// wait for all the requests to be handled in the background and send the batch response
+	c.inflight.Add(1)
+	c.wg.Add(1)
+	go func() {
+		defer recoverAndLog(c, &c.wg)
+		defer c.inflight.Add(-1)
+		wg.Wait()
+
+		// batch response omits notifications, and is not sent at all if the batch consisted only of notifications or responses
+		var batchRes []*response
+		for _, r := range res {
+			if r != nil {
+				batchRes = append(batchRes, r)
+			}
+		}
+		if len(batchRes) == 0 {
+			return
+		}
+		if err := c.sendWait(batchRes); err != nil {
+			log.Printf("conn: error sending batch response: %v", err)
+		}
+	}()
+	return true
+}
+
+// isBatch checks if the raw message is an array, which denotes a JSON-RPC batch.
+func isBatch(codec Codec, data []byte) bool {
+	switch codec {
+	case MsgPackCodec:
+		return len(data) > 0 && (data[0]&0xf0 == 0x90 || data[0] == 0xdc || data[0] == 0xdd)
+	case CBORCodec:
+		return len(data) > 0 && data[0]&0xe0 == cborArray
+	case JSONCodec:
+	default:
+		var msgs []rawValue
+		return codec.Unmarshal(data, &msgs) == nil
+	}
+
+	for _, b := range data {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// checkMessage validates a decoded incoming message against the JSON-RPC 2.0 specification.
+// decodeErr is the error (if any) returned while decoding the message.
+// Returns the error object to be sent back to the peer if the message is malformed, or nil otherwise.
+func checkMessage(m *message, decodeErr error) *ResError {
+	if decodeErr != nil {
+		if isSyntaxError(decodeErr) {
+			return &ResError{Code: ErrCodeParse, Message: "Parse error."}
+		}
+		return &ResError{Code: ErrCodeInvalidRequest, Message: "Invalid request."}
+	}
+
+	if m.JSONRPC != jsonrpcVersion {
+		return &ResError{Code: ErrCodeInvalidRequest, Message: "Invalid request: jsonrpc member must be exactly \"2.0\"."}
+	}
+	if !validID(m.ID) {
+		return &ResError{Code: ErrCodeInvalidRequest, Message: "Invalid request: id must be a string, number, or null."}
+	}
+	if m.Method == "" && m.Result.data == nil && m.Error == nil {
+		return &ResError{Code: ErrCodeInvalidRequest, Message: "Invalid request: message is neither a request nor a response."}
+	}
+
+	return nil
 }
 
 func recoverAndLog(c *Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
 	if err := recover(); err != nil {
-		c.Close()
+		c.closeWith(DisconnPanic, fmt.Errorf("conn: panic: %v", err))
 		const size = 64 << 10
 		buf := make([]byte, size)
 		buf = buf[:runtime.Stack(buf, false)]
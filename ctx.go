@@ -1,6 +1,7 @@
 package neptulon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,41 +14,65 @@ type ReqCtx struct {
 	Conn    *Conn      // Client connection.
 	Session *cmap.CMap // Session is a data store for storing arbitrary data within this context to communicate with other middleware handling this message.
 
-	ID     string      // Request ID.
+	ID     string      // Request ID. Empty for notifications.
 	Method string      // Called method.
 	Res    interface{} // Response to be returned.
 	Err    *ResError   // Error to be returned.
 
-	params  json.RawMessage // request parameters
-	mw      []func(ctx *ReqCtx) error
-	mwIndex int
+	ctx          context.Context // canceled when the connection is closed, the request timeout passes, or the peer cancels the request
+	cancel       context.CancelCauseFunc
+	credits      *streamCredits  // chunks that the peer allows to be sent with SendChunk
+	rawID        json.RawMessage // request ID as received (string, number, or null)
+	notification bool            // notifications are requests without an ID, which never get a response
+	params       rawValue        // request parameters
+	mw           []func(ctx *ReqCtx) error
+	mwIndex      int
 }
 
-func newReqCtx(conn *Conn, id, method string, params json.RawMessage, mw []func(ctx *ReqCtx) error) *ReqCtx {
+func newReqCtx(c context.Context, conn *Conn, id json.RawMessage, method string, params rawValue, mw []func(ctx *ReqCtx) error) *ReqCtx {
 	return &ReqCtx{
-		Conn:    conn,
-		Session: cmap.New(),
-		ID:      id,
-		Method:  method,
-		params:  params,
-		mw:      mw,
+		Conn:         conn,
+		Session:      cmap.New(),
+		ID:           idString(id),
+		Method:       method,
+		ctx:          c,
+		rawID:        id,
+		notification: id == nil,
+		params:       params,
+		mw:           mw,
 	}
 }
 
 // Params reads request parameters into given object.
 // Object should be passed by reference.
 func (ctx *ReqCtx) Params(v interface{}) error {
-	if ctx.params == nil {
+	if ctx.params.data == nil {
 		return errors.New("ctx: request did not have any request parameters")
 	}
 
-	if err := json.Unmarshal(ctx.params, v); err != nil {
+	if err := ctx.params.unmarshal(v); err != nil {
 		return fmt.Errorf("ctx: cannot deserialize request params: %v", err)
 	}
 
 	return nil
 }
 
+// Context returns the request context, which is canceled when the connection is closed, the request timeout passes,
+// or the peer cancels the request with a CancelRequestMethod notification.
+// Middleware should pass this context to any long running operation, like database calls.
+func (ctx *ReqCtx) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
+// IsNotification returns true if the request is a notification.
+// Response or error set on notification contexts is never sent back to the peer.
+func (ctx *ReqCtx) IsNotification() bool {
+	return ctx.notification
+}
+
 // Next executes the next middleware in the middleware stack.
 func (ctx *ReqCtx) Next() error {
 	ctx.mwIndex++
@@ -69,11 +94,12 @@ type ResCtx struct {
 	ErrorCode    int    // Error code (if any).
 	ErrorMessage string // Error message (if any).
 
-	result    json.RawMessage // result parameters
+	ctx       context.Context // context that the request was sent with
+	result    rawValue        // result parameters
 	errorData json.RawMessage // error data (if any)
 }
 
-func newResCtx(conn *Conn, id string, result json.RawMessage, err *resError) *ResCtx {
+func newResCtx(conn *Conn, id string, result rawValue, err *resError) *ResCtx {
 	r := ResCtx{
 		Conn:   conn,
 		ID:     id,
@@ -92,17 +118,25 @@ func newResCtx(conn *Conn, id string, result json.RawMessage, err *resError) *Re
 	return &r
 }
 
+// Context returns the context that the request was sent with.
+func (ctx *ResCtx) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
 // Result reads response result data into given object.
 // Object should be passed by reference.
 func (ctx *ResCtx) Result(v interface{}) error {
 	if !ctx.Success {
 		return errors.New("ctx: cannot read result data since server returned an error")
 	}
-	if ctx.result == nil {
+	if ctx.result.data == nil {
 		return errors.New("ctx: server did not return any response data")
 	}
 
-	if err := json.Unmarshal(ctx.result, v); err != nil {
+	if err := ctx.result.unmarshal(v); err != nil {
 		return fmt.Errorf("ctx: cannot deserialize response result: %v", err)
 	}
 	return nil
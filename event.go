@@ -0,0 +1,160 @@
+package neptulon
+
+// EventType is the type of a connection lifecycle event.
+type EventType int
+
+const (
+	// EventConnected is emitted when the connection is established.
+	// For reconnecting client connections, it is emitted for each reconnection as well.
+	EventConnected EventType = iota
+
+	// EventAuthenticated is emitted when the connection is authenticated with Conn.MarkAuthenticated, usually by an authentication middleware.
+	EventAuthenticated
+
+	// EventDisconnected is emitted when the connection is lost or closed, along with the disconnection reason.
+	// For reconnecting client connections, it is emitted each time the connection is lost, before reconnecting.
+	// For resumable server connections, it is emitted when the connection is lost and its session is suspended.
+	EventDisconnected
+
+	// EventResumed is emitted when a suspended session is resumed with a new underlying connection, after EventConnected.
+	// See Server.SetResumeGracePeriod for details.
+	EventResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventAuthenticated:
+		return "authenticated"
+	case EventDisconnected:
+		return "disconnected"
+	case EventResumed:
+		return "resumed"
+	}
+	return "unknown"
+}
+
+// DisconnReason is the reason of a disconnection.
+type DisconnReason int
+
+const (
+	// DisconnLocalClose denotes that the connection was closed locally with Conn.Close.
+	DisconnLocalClose DisconnReason = iota
+
+	// DisconnPeerClosed denotes that the peer closed the connection.
+	DisconnPeerClosed
+
+	// DisconnDeadlineExceeded denotes that the peer did not respond within the idle timeout, or a write deadline was exceeded.
+	DisconnDeadlineExceeded
+
+	// DisconnProtocolError denotes that the peer sent a malformed, unknown or too large message.
+	DisconnProtocolError
+
+	// DisconnMiddlewareError denotes that a request middleware, response handler, or reconnect handler returned an error.
+	DisconnMiddlewareError
+
+	// DisconnPanic denotes that a request middleware or response handler panicked.
+	DisconnPanic
+
+	// DisconnLimitReached denotes that the concurrency limit was reached with SaturationClose policy.
+	DisconnLimitReached
+
+	// DisconnNetworkError denotes any other error while reading from or writing to the connection.
+	DisconnNetworkError
+)
+
+func (r DisconnReason) String() string {
+	switch r {
+	case DisconnLocalClose:
+		return "local close"
+	case DisconnPeerClosed:
+		return "peer closed"
+	case DisconnDeadlineExceeded:
+		return "deadline exceeded"
+	case DisconnProtocolError:
+		return "protocol error"
+	case DisconnMiddlewareError:
+		return "middleware error"
+	case DisconnPanic:
+		return "panic"
+	case DisconnLimitReached:
+		return "limit reached"
+	case DisconnNetworkError:
+		return "network error"
+	}
+	return "unknown"
+}
+
+// Event is a connection lifecycle event.
+type Event struct {
+	Type   EventType     // Event type.
+	Conn   *Conn         // Client connection.
+	Reason DisconnReason // Disconnection reason, for EventDisconnected only.
+	Err    error         // Error that caused the disconnection (if any), for EventDisconnected only.
+}
+
+// EventHandler registers a function to handle connection lifecycle events.
+// Handler is called synchronously from the goroutine that caused the event, so it should not block.
+func (c *Conn) EventHandler(handler func(e *Event)) {
+	c.eventHandler = handler
+}
+
+// MarkAuthenticated stores the given user ID with the key "userid" in session and emits an EventAuthenticated event.
+// Authentication middleware should call this once the connection is authenticated.
+func (c *Conn) MarkAuthenticated(userID string) {
+	c.Session.Set("userid", userID)
+	c.eventHandler(&Event{Type: EventAuthenticated, Conn: c})
+}
+
+// DisconnReason returns the reason of the last disconnection. Only meaningful once the connection is lost or closed.
+func (c *Conn) DisconnReason() DisconnReason {
+	c.disconnMutex.Lock()
+	defer c.disconnMutex.Unlock()
+	return c.disconn.reason
+}
+
+// Err returns the error that caused the last disconnection, i.e. ErrIdleTimeout if the peer stopped responding, or io.EOF if the peer closed the connection.
+// Returns nil if the connection is alive or was closed locally. Disconnection handler can use this to tell why the connection was lost.
+func (c *Conn) Err() error {
+	c.disconnMutex.Lock()
+	defer c.disconnMutex.Unlock()
+	return c.disconn.err
+}
+
+// closeWith closes the underlying connection for the given reason.
+// Unlike Close, reconnecting client connections reconnect afterwards if the reason denotes a lost connection.
+func (c *Conn) closeWith(reason DisconnReason, err error) {
+	c.setReason(reason, err)
+	c.disconnect()
+}
+
+// setReason sets the reason of the disconnection for the current underlying connection.
+// Only the first reason is kept, since the rest are usually consequences of the first.
+func (c *Conn) setReason(reason DisconnReason, err error) {
+	c.disconnMutex.Lock()
+	defer c.disconnMutex.Unlock()
+	if c.disconn.set {
+		return
+	}
+	c.disconn = disconnReason{set: true, reason: reason, err: err}
+}
+
+// resetReason clears the disconnection reason for a new underlying connection.
+func (c *Conn) resetReason() {
+	c.disconnMutex.Lock()
+	c.disconn = disconnReason{}
+	c.disconnMutex.Unlock()
+}
+
+// lost returns true if the reason denotes a lost connection, as opposed to a connection closed on purpose.
+func (r DisconnReason) lost() bool {
+	return r == DisconnPeerClosed || r == DisconnDeadlineExceeded || r == DisconnNetworkError
+}
+
+// disconnReason is the disconnection reason of the underlying connection.
+type disconnReason struct {
+	set    bool
+	reason DisconnReason
+	err    error
+}
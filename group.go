@@ -0,0 +1,121 @@
+package neptulon
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+)
+
+// groups is a registry of named groups of client connections, i.e. rooms.
+// Groups are created when the first connection joins and removed when the last connection leaves.
+type groups struct {
+	mutex         sync.RWMutex
+	members       map[string]map[string]*Conn // group name -> conn ID -> *Conn
+	joined        map[string]map[string]bool  // conn ID -> group names
+	groupsCounter *expvar.Int                 // number of groups
+	memberCounter *expvar.Int                 // number of group memberships
+}
+
+func newGroups(groupsCounter, memberCounter *expvar.Int) *groups {
+	return &groups{
+		members:       make(map[string]map[string]*Conn),
+		joined:        make(map[string]map[string]bool),
+		groupsCounter: groupsCounter,
+		memberCounter: memberCounter,
+	}
+}
+
+// join adds the connection to the group. Returns false if the connection was already in the group.
+// Caller should hold the write lock.
+func (g *groups) join(c *Conn, group string) bool {
+	if g.members[group][c.ID] != nil {
+		return false
+	}
+
+	if g.members[group] == nil {
+		g.members[group] = make(map[string]*Conn)
+		g.groupsCounter.Add(1)
+	}
+	if g.joined[c.ID] == nil {
+		g.joined[c.ID] = make(map[string]bool)
+	}
+	g.members[group][c.ID] = c
+	g.joined[c.ID][group] = true
+	g.memberCounter.Add(1)
+	return true
+}
+
+// leave removes the connection from the group. Returns false if the connection was not in the group.
+// Caller should hold the write lock.
+func (g *groups) leave(connID, group string) bool {
+	if g.members[group][connID] == nil {
+		return false
+	}
+
+	delete(g.members[group], connID)
+	delete(g.joined[connID], group)
+	g.memberCounter.Add(-1)
+	if len(g.members[group]) == 0 {
+		delete(g.members, group)
+		g.groupsCounter.Add(-1)
+	}
+	if len(g.joined[connID]) == 0 {
+		delete(g.joined, connID)
+	}
+	return true
+}
+
+// leaveAll removes the connection from all the groups it is in.
+func (g *groups) leaveAll(connID string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for group := range g.joined[connID] {
+		g.leave(connID, group)
+	}
+}
+
+// conns returns the connections in the group.
+func (g *groups) conns(group string) []*Conn {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	conns := make([]*Conn, 0, len(g.members[group]))
+	for _, c := range g.members[group] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// connIDs returns the IDs of the connections in the group, in sorted order.
+func (g *groups) connIDs(group string) []string {
+	conns := g.conns(group)
+	ids := make([]string, len(conns))
+	for i, c := range conns {
+		ids[i] = c.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// names returns the names of all the groups, in sorted order.
+func (g *groups) names() []string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	names := make([]string, 0, len(g.members))
+	for group := range g.members {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupsOf returns the names of the groups that the connection is in, in sorted order.
+func (g *groups) groupsOf(connID string) []string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	names := make([]string, 0, len(g.joined[connID]))
+	for group := range g.joined[connID] {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	return names
+}
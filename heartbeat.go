@@ -0,0 +1,118 @@
+package neptulon
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// DefaultPingInterval is the default interval between WebSocket pings sent through connections.
+const DefaultPingInterval = time.Minute
+
+// DefaultIdleTimeout is the default duration of inactivity after which connections are closed.
+const DefaultIdleTimeout = time.Second * 300
+
+// ErrIdleTimeout is the disconnection reason for connections closed since nothing was received from the peer within the idle timeout,
+// not even a pong in response to our pings.
+var ErrIdleTimeout = errors.New("conn: peer did not respond within the idle timeout")
+
+// pingCodec sends WebSocket ping control frames.
+// Peer responds to pings with pong frames, which are handled internally by the websocket package and never returned by Receive.
+var pingCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// activityConn is a net.Conn wrapper which extends the read deadline of the connection upon every read.
+// Since it sits below the websocket package, any received frame, including pongs, counts as activity.
+type activityConn struct {
+	net.Conn
+	r           io.Reader     // reader to read from, which might be a buffered reader wrapping the connection
+	idleTimeout time.Duration // should be set before reading from the connection starts
+}
+
+func (a *activityConn) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 && a.idleTimeout > 0 {
+		a.Conn.SetReadDeadline(time.Now().Add(a.idleTimeout))
+	}
+	return n, err
+}
+
+// activityConnKey is the request context key for the *activityConn of incoming WebSocket connections.
+type activityConnKey struct{}
+
+// activityHijacker is an http.ResponseWriter wrapper which wraps the hijacked connection of a WebSocket upgrade request in the given activityConn.
+type activityHijacker struct {
+	http.ResponseWriter
+	conn *activityConn
+}
+
+func (h *activityHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rwc, buf, err := h.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// read through the original buffered reader as it might already contain some data from the connection
+	h.conn.Conn, h.conn.r = rwc, buf.Reader
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), buf.Writer), nil
+}
+
+// activityHandler wraps the WebSocket handler so that incoming connections track read activity.
+// Handler can retrieve the *activityConn of the connection from the request context with activityConnKey.
+func activityHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac := &activityConn{}
+		h.ServeHTTP(&activityHijacker{ResponseWriter: w, conn: ac}, r.WithContext(context.WithValue(r.Context(), activityConnKey{}, ac)))
+	})
+}
+
+// dialActivity opens a new client WebSocket connection to the given address over an activityConn,
+// requesting the given subprotocols and sending the given handshake headers.
+func dialActivity(addr, origin string, protocols []string, header http.Header) (*websocket.Conn, *activityConn, error) {
+	config, err := websocket.NewConfig(addr, origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Protocol = protocols
+	for k, v := range header {
+		config.Header[k] = v
+	}
+
+	host := config.Location.Host
+	var nc net.Conn
+	switch config.Location.Scheme {
+	case "ws":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "80")
+		}
+		nc, err = net.Dial("tcp", host)
+	case "wss":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "443")
+		}
+		nc, err = tls.Dial("tcp", host, config.TlsConfig)
+	default:
+		err = websocket.ErrBadScheme
+	}
+	if err != nil {
+		return nil, nil, &websocket.DialError{Config: config, Err: err}
+	}
+
+	ac := &activityConn{Conn: nc, r: nc}
+	ws, err := websocket.NewClient(config, ac)
+	if err != nil {
+		nc.Close()
+		return nil, nil, &websocket.DialError{Config: config, Err: err}
+	}
+	return ws, ac, nil
+}
@@ -0,0 +1,59 @@
+package neptulon
+
+// SaturationPolicy determines how incoming requests are handled once a concurrency limit is reached.
+type SaturationPolicy int
+
+const (
+	// SaturationBlock stops reading from the connection until a request handler goroutine becomes available.
+	SaturationBlock SaturationPolicy = iota
+
+	// SaturationReject rejects the request with an ErrCodeServerBusy error response.
+	SaturationReject
+
+	// SaturationClose closes the connection.
+	SaturationClose
+)
+
+// limiter bounds the number of goroutines concurrently handling incoming requests, effectively making them a worker pool.
+// A nil limiter does not impose any limits.
+type limiter struct {
+	slots  chan struct{}
+	policy SaturationPolicy
+}
+
+// newLimiter creates a new limiter with the given concurrency limit.
+// Returns nil if the limit is zero or less, which means no limit.
+func newLimiter(limit int, policy SaturationPolicy) *limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &limiter{slots: make(chan struct{}, limit), policy: policy}
+}
+
+// acquire reserves a slot for a request handler goroutine.
+// If all slots are in use, blocks until a slot is available if the policy is SaturationBlock, otherwise returns false right away.
+func (l *limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	if l.policy == SaturationBlock {
+		l.slots <- struct{}{}
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot reserved with acquire.
+func (l *limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -1,19 +1,74 @@
 package neptulon
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// JSON-RPC protocol version emitted with all outgoing messages.
+const jsonrpcVersion = "2.0"
+
+// Standard JSON-RPC 2.0 error codes.
+const (
+	ErrCodeParse          = -32700 // Invalid JSON was received.
+	ErrCodeInvalidRequest = -32600 // The JSON sent is not a valid request object.
+	ErrCodeMethodNotFound = -32601 // The method does not exist or is not available.
+	ErrCodeInvalidParams  = -32602 // Invalid method parameters.
+	ErrCodeInternal       = -32603 // Internal JSON-RPC error.
+)
+
+// Implementation-defined error codes, from the range reserved for implementation-defined server errors (-32000 to -32099).
+const (
+	ErrCodeTimeout      = -32000 // Response was not received within the request timeout. Synthesized locally.
+	ErrCodeDisconnected = -32001 // Connection was closed before a response was received. Synthesized locally.
+	ErrCodeServerBusy   = -32002 // Request was rejected since the concurrency limit was reached.
+	ErrCodeShuttingDown = -32003 // Request was rejected since the server is shutting down.
+)
+
+// CancelRequestMethod is the reserved method name for request cancellation notifications, same as in LSP.
+// Notification params are in the form {"id": <ID of the request to be canceled>}.
+// Conn sends this notification when it gives up on a pending request, and cancels the context of the
+// corresponding in-flight request when it receives one.
+const CancelRequestMethod = "$/cancelRequest"
+
+// ShutdownMethod is the reserved method name for the notification that the server sends to all client connections
+// when it starts shutting down, if enabled with Server.SetShutdownNotice. Notification does not have any params.
+// Clients can handle it with a middleware like any other notification, i.e. to stop sending new requests.
+const ShutdownMethod = "$/shutdown"
+
+// Request cancellation notification params.
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// ErrCodeCanceled is the error code for requests that were canceled before a response was received.
+// Same as the LSP RequestCancelled error code.
+const ErrCodeCanceled = -32800
 
 // Outgoing JSON-RPC request object representation.
+// Notifications are requests without an ID.
 type request struct {
-	ID     string      `json:"id"`
-	Method string      `json:"method"`
-	Params interface{} `json:"params,omitempty"`
+	JSONRPC string      `json:"jsonrpc"`
+	ID      string      `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
 }
 
 // Outgoing JSON-RPC response object representation.
+// ID is kept in its raw form so that string, numeric and null IDs are echoed back exactly as they were received.
 type response struct {
-	ID     string      `json:"id"`
-	Result interface{} `json:"result,omitempty"`
-	Error  *ResError   `json:"error,omitempty"`
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *ResError       `json:"error,omitempty"`
+}
+
+// BatchRequest is a single request or notification within a batch of requests sent in a single message.
+type BatchRequest struct {
+	Method     string                  // Method to be called.
+	Params     interface{}             // Request parameters (if any).
+	ResHandler func(ctx *ResCtx) error // Called when a response is returned. If nil, request is sent as a notification.
 }
 
 // ResError is a JSON-RPC response error object representation for outgoing responses.
@@ -23,15 +78,27 @@ type ResError struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// CallError is a JSON-RPC error response returned by a synchronous call.
+type CallError struct {
+	Code    int             // Error code.
+	Message string          // Error message.
+	Data    json.RawMessage // Error data (if any).
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("jsonrpc: error response: %v: %v", e.Code, e.Message)
+}
+
 // Generic (request or response) JSON-RPC message representation for incoming messages.
 // Initially we don't know the received message type so rely on a generic type that contains everything.
 // If Method field is not empty, this is a request message, otherwise a response.
 type message struct {
-	ID     string          `json:"id,omitempty"`
-	Method string          `json:"method,omitempty"`
-	Params json.RawMessage `json:"params,omitempty"` // request params
-	Result json.RawMessage `json:"result,omitempty"` // response result
-	Error  *resError       `json:"error,omitempty"`  // response error
+	JSONRPC string          `json:"jsonrpc,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // string, number, or null
+	Method  string          `json:"method,omitempty"`
+	Params  rawValue        `json:"params,omitempty"` // request params, in the wire format
+	Result  rawValue        `json:"result,omitempty"` // response result, in the wire format
+	Error   *resError       `json:"error,omitempty"`  // response error
 }
 
 // Incoming JSON-RPC response error object representation.
@@ -40,3 +107,35 @@ type resError struct {
 	Message string          `json:"message"`
 	Data    json.RawMessage `json:"data,omitempty"`
 }
+
+// nullID is the raw JSON-RPC ID used in responses to messages whose ID could not be determined.
+var nullID = json.RawMessage("null")
+
+// idString returns the string form of a raw JSON-RPC ID.
+// String IDs are unquoted, numeric IDs are returned as is, and null or missing IDs yield an empty string.
+func idString(id json.RawMessage) string {
+	if len(id) == 0 || bytes.Equal(id, nullID) {
+		return ""
+	}
+
+	var s string
+	if err := json.Unmarshal(id, &s); err == nil {
+		return s
+	}
+
+	return string(id)
+}
+
+// validID checks that the raw JSON-RPC ID is a string, a number, or null, as required by the specification.
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+
+	return false
+}
@@ -20,7 +20,7 @@ func CertAtuh(ctx *neptulon.ReqCtx) error {
 	// }
 	//
 	// userID := certs[0].Subject.CommonName
-	// ctx.Session.Set("userid", userID)
+	// ctx.Conn.MarkAuthenticated(userID)
 	// log.Printf("Client authenticated. TLS/IP: %v, User ID: %v, Conn ID: %v\n", ctx.Conn.RemoteAddr(), userID, ctx.Conn.ID)
 	return ctx.Next()
 }
@@ -44,7 +44,7 @@ func HMAC(password string) func(ctx *neptulon.ReqCtx) error {
 		}
 
 		userID := jt.Claims["userid"].(string)
-		ctx.Conn.Session.Set("userid", userID)
+		ctx.Conn.MarkAuthenticated(userID)
 		log.Printf("mw: jwt: client authenticated, user: %v, conn: %v, ip: %v", userID, ctx.Conn.ID, ctx.Conn.RemoteAddr())
 		return ctx.Next()
 	}
@@ -0,0 +1,286 @@
+package neptulon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// msgpackCodec encodes messages in MessagePack. []byte values are encoded as binary values, and extension types are not supported.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return marshalBinary(c, v) }
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error { return unmarshalBinary(c, data, v) }
+
+func (msgpackCodec) encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMsgPack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) decodeValue(data []byte) (interface{}, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: trailing data after msgpack value", errDecode)
+	}
+	return v, nil
+}
+
+// encodeMsgPack encodes a generic value.
+func encodeMsgPack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		n, err := numberValue(v)
+		if err != nil {
+			return err
+		}
+		return encodeMsgPack(buf, n)
+	case int64:
+		encodeMsgPackInt(buf, v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			encodeMsgPackInt(buf, int64(v))
+			break
+		}
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, v)
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		encodeMsgPackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []byte:
+		encodeMsgPackHeader(buf, len(v), 0, 0, 0xc4, 0xc5, 0xc6)
+		buf.Write(v)
+	case []interface{}:
+		encodeMsgPackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := encodeMsgPack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeMsgPackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			encodeMsgPack(buf, k)
+			if err := encodeMsgPack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as msgpack", v)
+	}
+	return nil
+}
+
+// encodeMsgPackInt encodes an integer in the most compact form.
+func encodeMsgPackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// encodeMsgPackHeader encodes the type and length header of a string, array or map.
+// fix is the fix-length type prefix which can hold lengths up to fixMax, and len8, len16, len32 are the type prefixes
+// for 8, 16 and 32 bit lengths respectively. len8 is zero for types which do not have an 8 bit length form.
+func encodeMsgPackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, len8, len16, len32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case len8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(len8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(len16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(len32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackDecoder decodes MessagePack values into generic values.
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int // nesting depth of the value being decoded
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, fmt.Errorf("%w: unexpected end of msgpack data", errDecode)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads an n byte big endian unsigned integer.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	if d.depth++; d.depth > maxDecodeDepth {
+		return nil, fmt.Errorf("%w: msgpack nesting depth exceeds %v", errDecode, maxDecodeDepth)
+	}
+	defer func() { d.depth-- }()
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.decodeMap(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return d.decodeArray(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.decodeString(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.next(int(n))
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8/16/32/64
+		return d.uint(1 << (t - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8/16/32/64
+		size := 1 << (t - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - size*8)
+		return int64(u<<shift) >> shift, nil // sign extend
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd: // array 16/32
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf: // map 16/32
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+
+	return nil, fmt.Errorf("%w: unsupported msgpack type 0x%x", errDecode, t)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: msgpack array length exceeds data", errDecode)
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: msgpack map length exceeds data", errDecode)
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: msgpack map keys must be strings", errDecode)
+		}
+		if m[ks], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,125 @@
+package neptulon
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/neptulon/shortid"
+)
+
+// SetStore sets the store that keeps the requests sent with DeliverToUser until they are answered.
+// This should be called before starting the server.
+func (s *Server) SetStore(store Store) {
+	s.store = store
+}
+
+// DeliveryHandler registers a function to handle the responses to the requests sent with DeliverToUser.
+// Handler is called once per request, with the response from whichever connection of the user answered first.
+func (s *Server) DeliveryHandler(handler func(req *StoredRequest, ctx *ResCtx)) {
+	s.deliveryHandler = handler
+}
+
+// DeliverToUser stores a JSON-RPC request for the user and sends it to all the authenticated connections of the user, if any.
+// Request stays in the store until one of the connections returns a response, and is sent again to each connection that
+// the user authenticates afterwards, so users who are offline receive it once they connect. Requests are therefore delivered
+// at least once. Params are stored in JSON, so []byte values are sent as base64 encoded strings.
+// Returns the ID of the stored request. Store should be set with SetStore beforehand.
+func (s *Server) DeliverToUser(userID string, method string, params interface{}) (id string, err error) {
+	if !s.running.Load().(bool) {
+		return "", errors.New("use of closed server")
+	}
+	if s.store == nil {
+		return "", errors.New("server: no store is set for delivering requests")
+	}
+
+	req := &StoredRequest{UserID: userID, Method: method, Time: time.Now()}
+	if req.ID, err = shortid.UUID(); err != nil {
+		return "", err
+	}
+	if params != nil {
+		if req.Params, err = json.Marshal(params); err != nil {
+			return "", err
+		}
+	}
+	if err := s.store.Add(req); err != nil {
+		return "", err
+	}
+
+	for _, c := range s.users.conns(userID) {
+		s.sendStored(c, req)
+	}
+	return req.ID, nil
+}
+
+// replayStored sends all the stored requests of the user through the newly authenticated connection.
+// Requests that were already sent through the connection and not answered yet are not sent again, i.e. upon re-authentication.
+func (s *Server) replayStored(c *Conn, userID string) {
+	reqs, err := s.store.Get(userID)
+	if err != nil {
+		log.Printf("server: error reading stored requests of user %v: %v", userID, err)
+		return
+	}
+
+	for _, req := range reqs {
+		s.sendStored(c, req)
+	}
+}
+
+// sendStored sends the stored request through the connection, and removes it from the store once a response is returned.
+// Does nothing if the request was already sent through the connection and is not answered yet.
+func (s *Server) sendStored(c *Conn, req *StoredRequest) {
+	c.storedMutex.Lock()
+	if c.storedSent[req.ID] {
+		c.storedMutex.Unlock()
+		return
+	}
+	if c.storedSent == nil {
+		c.storedSent = make(map[string]bool)
+	}
+	c.storedSent[req.ID] = true
+	c.storedMutex.Unlock()
+	release := func() {
+		c.storedMutex.Lock()
+		delete(c.storedSent, req.ID)
+		c.storedMutex.Unlock()
+	}
+
+	var params interface{}
+	if req.Params != nil {
+		params = req.Params
+	}
+
+	_, err := c.SendRequest(req.Method, params, func(ctx *ResCtx) error {
+		release()
+		// locally synthesized error responses mean that the peer did not answer, and busy or shutting down peers reject requests
+		// without handling them, so the request is kept to be sent again
+		if !ctx.Success && isRetryable(ctx.ErrorCode) {
+			return nil
+		}
+
+		removed, err := s.store.Remove(req.UserID, req.ID)
+		if err != nil {
+			log.Printf("server: error removing stored request %v of user %v: %v", req.ID, req.UserID, err)
+			return nil
+		}
+		if removed {
+			s.deliveryHandler(req, ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		release()
+		log.Printf("server: error sending stored request %v to %v: %v", req.ID, c.ID, err)
+	}
+}
+
+// isRetryable returns true if the error response with the given code means that the request was not handled by the peer.
+func isRetryable(code int) bool {
+	switch code {
+	case ErrCodeTimeout, ErrCodeDisconnected, ErrCodeCanceled, ErrCodeServerBusy, ErrCodeShuttingDown:
+		return true
+	}
+	return false
+}
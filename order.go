@@ -0,0 +1,55 @@
+package neptulon
+
+import "sync"
+
+// OrderByMethod is an order key function to be used with SetOrderKey, which serializes requests per method name.
+func OrderByMethod(ctx *ReqCtx) string {
+	return ctx.Method
+}
+
+// orderAll is the order key function which serializes all requests.
+func orderAll(ctx *ReqCtx) string {
+	return "*"
+}
+
+// serializer runs functions that share the same key one at a time, in the order they were submitted.
+// Functions with different keys run concurrently.
+type serializer struct {
+	mutex  sync.Mutex
+	queues map[string][]func() // key -> functions waiting to be run; key exists as long as a goroutine is draining its queue
+}
+
+func newSerializer() *serializer {
+	return &serializer{queues: make(map[string][]func())}
+}
+
+// run runs fn in a background goroutine once all the previously submitted functions with the same key are completed.
+func (s *serializer) run(key string, fn func()) {
+	s.mutex.Lock()
+	q, draining := s.queues[key]
+	s.queues[key] = append(q, fn)
+	s.mutex.Unlock()
+
+	if !draining {
+		go s.drain(key)
+	}
+}
+
+// drain runs the queued functions for the given key one by one until the queue is empty.
+func (s *serializer) drain(key string) {
+	for {
+		s.mutex.Lock()
+		q := s.queues[key]
+		if len(q) == 0 {
+			delete(s.queues, key)
+			s.mutex.Unlock()
+			return
+		}
+		fn := q[0]
+		q[0] = nil
+		s.queues[key] = q[1:]
+		s.mutex.Unlock()
+
+		fn()
+	}
+}
@@ -0,0 +1,175 @@
+package neptulon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+)
+
+var topicsCounter = expvar.NewInt("topics")
+var subscriptionsCounter = expvar.NewInt("subscriptions")
+
+// Reserved method names for the publish/subscribe messages.
+const (
+	// SubscribeMethod is the reserved method name for the requests that client connections send to subscribe to a topic.
+	// Request params are in the form {"topic": <topic pattern>}.
+	SubscribeMethod = "$/subscribe"
+
+	// UnsubscribeMethod is the reserved method name for the requests that client connections send to unsubscribe from a topic.
+	// Request params are in the form {"topic": <topic pattern>}, with the same pattern that was subscribed to.
+	UnsubscribeMethod = "$/unsubscribe"
+
+	// PublishMethod is the reserved method name for the notifications that the server sends to the subscribers of a topic.
+	// Notification params are in the form {"topic": <topic>, "data": <published data>}, which can be read into a Publication.
+	PublishMethod = "$/publish"
+)
+
+// Publication is the params of a PublishMethod notification.
+type Publication struct {
+	Topic string          `json:"topic"` // Topic that the data was published to.
+	Data  json.RawMessage `json:"data"`  // Published data.
+}
+
+// Subscription request params.
+type topicParams struct {
+	Topic string `json:"topic"`
+}
+
+// Outgoing PublishMethod notification params.
+type publishParams struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Subscribe subscribes the connection to the topic pattern and blocks until the server acknowledges the subscription.
+// Topics are dot separated tokens (i.e. "chat.room1.messages"). In patterns, "*" matches any single token,
+// and ">" at the end matches one or more trailing tokens (i.e. "chat.*.messages" or "chat.>").
+// Published data is received as PublishMethod notifications, which can be handled with a middleware.
+func (c *Conn) Subscribe(ctx context.Context, topic string) error {
+	return c.Call(ctx, SubscribeMethod, topicParams{Topic: topic}, nil)
+}
+
+// Unsubscribe unsubscribes the connection from the topic pattern and blocks until the server acknowledges it.
+func (c *Conn) Unsubscribe(ctx context.Context, topic string) error {
+	return c.Call(ctx, UnsubscribeMethod, topicParams{Topic: topic}, nil)
+}
+
+// Publish sends the data to all the client connections subscribed to a pattern that matches the topic.
+// Data is sent as a PublishMethod notification, once per connection even if the connection is subscribed to multiple matching patterns.
+// If the server is connected to a backplane, data is published on all the nodes.
+func (s *Server) Publish(topic string, data interface{}) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+	if !validTopic(topic, false) {
+		return errors.New("server: invalid topic: " + topic)
+	}
+
+	err := s.publishLocal(topic, data)
+	if s.backplane != nil {
+		raw, merr := json.Marshal(data)
+		if merr != nil {
+			return merr
+		}
+		if berr := s.sendBackplane("", &backplaneMessage{Type: bpPublish, Topic: topic, Params: raw}); berr != nil && err == nil {
+			err = berr
+		}
+	}
+	return err
+}
+
+// publishLocal sends the data to the connections on this server that are subscribed to a pattern that matches the topic.
+func (s *Server) publishLocal(topic string, data interface{}) error {
+	s.subs.mutex.RLock()
+	var conns []*Conn
+	seen := make(map[string]bool)
+	for pattern, members := range s.subs.members {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		for id, c := range members {
+			if !seen[id] {
+				seen[id] = true
+				conns = append(conns, c)
+			}
+		}
+	}
+	s.subs.mutex.RUnlock()
+
+	return notifyAll(conns, PublishMethod, publishParams{Topic: topic, Data: data})
+}
+
+// Topics returns the topic patterns with at least one subscriber, in sorted order.
+func (s *Server) Topics() []string {
+	return s.subs.names()
+}
+
+// Subscribers returns the IDs of the connections subscribed to the topic pattern, in sorted order.
+func (s *Server) Subscribers(pattern string) []string {
+	return s.subs.connIDs(pattern)
+}
+
+// handleSubscriptions is the server middleware handling SubscribeMethod and UnsubscribeMethod requests.
+// It is registered after all the other server middleware, so authentication middleware can reject subscriptions before they reach here.
+func (s *Server) handleSubscriptions(ctx *ReqCtx) error {
+	if ctx.Method != SubscribeMethod && ctx.Method != UnsubscribeMethod {
+		return ctx.Next()
+	}
+
+	var p topicParams
+	if err := ctx.Params(&p); err != nil || !validTopic(p.Topic, true) {
+		ctx.Err = &ResError{Code: ErrCodeInvalidParams, Message: "Invalid topic."}
+		return ctx.Next()
+	}
+
+	s.subs.mutex.Lock()
+	if ctx.Method == SubscribeMethod {
+		// the check is done while holding the lock so that the connection cannot be unsubscribed on disconnection in between
+		if _, ok := s.conns.GetOk(ctx.Conn.ID); ok {
+			s.subs.join(ctx.Conn, p.Topic)
+		}
+	} else {
+		s.subs.leave(ctx.Conn.ID, p.Topic)
+	}
+	s.subs.mutex.Unlock()
+
+	ctx.Res = true
+	return ctx.Next()
+}
+
+// validTopic returns true if the topic is made of non-empty dot separated tokens.
+// If pattern is true, "*" tokens and a trailing ">" token are allowed as wildcards.
+func validTopic(topic string, pattern bool) bool {
+	if topic == "" {
+		return false
+	}
+
+	tokens := strings.Split(topic, ".")
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return false
+		case t == "*" || t == ">":
+			if !pattern || (t == ">" && i != len(tokens)-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchTopic returns true if the topic matches the pattern.
+func matchTopic(pattern, topic string) bool {
+	p, t := strings.Split(pattern, "."), strings.Split(topic, ".")
+	for i, token := range p {
+		if token == ">" {
+			return len(t) > i
+		}
+		if i >= len(t) || (token != "*" && token != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
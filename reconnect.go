@@ -0,0 +1,156 @@
+package neptulon
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ConnState is the state of a client connection, as reported to the state handler.
+type ConnState int
+
+const (
+	// StateConnected denotes that the connection is established. For reconnecting client connections,
+	// this is reported after each successful reconnection, once the reconnect handler returns.
+	StateConnected ConnState = iota
+
+	// StateReconnecting denotes that the connection is lost and the client is trying to reconnect.
+	StateReconnecting
+
+	// StateDisconnected denotes that the connection is closed for good.
+	StateDisconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// Backoff is a jittered exponential backoff configuration for reconnecting client connections.
+// Delay before the nth reconnection attempt (starting from zero) is Min * Factor^n, capped at Max,
+// randomized by up to ±Jitter fraction of the delay.
+type Backoff struct {
+	Min        time.Duration // Delay before the first reconnection attempt. Should be positive.
+	Max        time.Duration // Maximum delay between reconnection attempts. Zero means no limit.
+	Factor     float64       // Multiplier applied to the delay after each failed attempt. Should be at least 1.
+	Jitter     float64       // Randomization fraction in the range [0, 1].
+	MaxRetries int           // Maximum number of consecutive reconnection attempts. Zero means no limit.
+}
+
+// DefaultBackoff is the default reconnection backoff configuration.
+var DefaultBackoff = Backoff{
+	Min:    time.Millisecond * 100,
+	Max:    time.Second * 30,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+// delay returns the delay before the given reconnection attempt.
+func (b *Backoff) delay(attempt int) time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if max := float64(b.Max); max > 0 && d > max {
+		d = max
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	// without a maximum, delay eventually overflows, and converting it to a duration would not yield a meaningful value
+	if d >= math.MaxInt64 || math.IsNaN(d) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// SetReconnect enables automatic reconnection for client connections with the given backoff configuration.
+// When the connection to the server is lost, it is redialed until it succeeds or backoff.MaxRetries is reached.
+// The same Conn object is kept, along with its ID and Session data. Requests pending at the time of the disconnection
+// fail with ErrCodeDisconnected. Connections closed with Close, or due to protocol errors, are not reconnected.
+// If the server has session resumption enabled (see Server.SetResumeGracePeriod), the server side session is resumed as well.
+// Passing nil disables reconnection, which is the default. This should be called before connecting.
+// Returns an error if backoff.Min is not positive, backoff.Factor is less than 1, or backoff.Jitter is not in the range [0, 1].
+func (c *Conn) SetReconnect(backoff *Backoff) error {
+	if backoff != nil {
+		if backoff.Min <= 0 {
+			return fmt.Errorf("conn: backoff min delay must be positive, got: %v", backoff.Min)
+		}
+		if backoff.Factor < 1 {
+			return fmt.Errorf("conn: backoff factor must be at least 1, got: %v", backoff.Factor)
+		}
+		// jitter greater than 1 could make the delay negative
+		if !(backoff.Jitter >= 0 && backoff.Jitter <= 1) {
+			return fmt.Errorf("conn: backoff jitter must be in the range [0, 1], got: %v", backoff.Jitter)
+		}
+	}
+	c.backoff = backoff
+	return nil
+}
+
+// ReconnHandler registers a function to be called after each successful reconnection, i.e. to re-authenticate.
+// Handler is called in a separate goroutine while the connection is receiving messages, so it can send requests and wait for responses.
+// If the handler returns an error, the connection is closed for good.
+func (c *Conn) ReconnHandler(handler func(c *Conn) error) {
+	c.reconnHandler = handler
+}
+
+// StateHandler registers a function to handle client connection state changes.
+func (c *Conn) StateHandler(handler func(c *Conn, state ConnState)) {
+	c.stateHandler = handler
+}
+
+// reconnect redials the server with backoff until it succeeds, the retry limit is reached, or the connection is closed with Close.
+// Returns true if the connection is re-established.
+func (c *Conn) reconnect() bool {
+	c.stateHandler(c, StateReconnecting)
+	for attempt := 0; c.backoff.MaxRetries <= 0 || attempt < c.backoff.MaxRetries; attempt++ {
+		select {
+		case <-time.After(c.backoff.delay(attempt)):
+		case <-c.closed:
+			return false
+		}
+
+		ws, ac, err := c.dial()
+		if err != nil {
+			log.Printf("conn: reconnection attempt %v failed %v: %v, %v", attempt+1, c.ID, c.addr, err)
+			continue
+		}
+		if err := c.setConn(ws, ac); err != nil {
+			log.Printf("conn: reconnection attempt %v failed %v: %v, %v", attempt+1, c.ID, c.addr, err)
+			continue
+		}
+
+		// connection might have been closed for good while we were dialing
+		select {
+		case <-c.closed:
+			c.disconnect()
+			return false
+		default:
+		}
+
+		log.Printf("conn: reconnected %v: %v", c.ID, c.RemoteAddr())
+		c.wg.Add(1)
+		go func() {
+			defer recoverAndLog(c, &c.wg)
+			if err := c.reconnHandler(c); err != nil {
+				log.Printf("conn: reconnect handler returned error, closing connection %v: %v, %v", c.ID, c.RemoteAddr(), err)
+				c.setReason(DisconnMiddlewareError, err)
+				c.Close()
+				return
+			}
+			c.stateHandler(c, StateConnected)
+		}()
+		return true
+	}
+
+	log.Printf("conn: giving up reconnecting after %v attempts %v: %v", c.backoff.MaxRetries, c.ID, c.addr)
+	return false
+}
@@ -0,0 +1,313 @@
+package neptulon
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/neptulon/cmap"
+	"github.com/neptulon/shortid"
+
+	"golang.org/x/net/websocket"
+)
+
+// SessionMethod is the reserved method name for the notification that the server sends to each client connection
+// right after it connects, if session resumption is enabled with Server.SetResumeGracePeriod.
+// Notification params are in the form {"token": <resume token>, "resumed": <true if an earlier session was resumed>}.
+// Client connections handle it internally and send the last received token in the ResumeHeader when reconnecting.
+const SessionMethod = "$/session"
+
+// ResumeHeader is the HTTP header that client connections send the resume token in, during the WebSocket handshake.
+const ResumeHeader = "Neptulon-Resume-Token"
+
+// SessionMethod notification params.
+type sessionParams struct {
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+// suspendedSession is a lost connection waiting to be resumed until its timer expires.
+type suspendedSession struct {
+	conn  *Conn
+	timer *time.Timer
+}
+
+// SetResumeGracePeriod enables session resumption for client connections, keeping the sessions of lost connections for the given duration.
+// When a connection is lost, the Conn object is kept along with its ID, Session data, rooms, user and subscriptions,
+// and the requests sent through it that are still pending. Messages sent to it meanwhile are kept as well.
+// If the client reconnects with the resume token it was given within the grace period, the same Conn object continues
+// with the new underlying connection: the pending requests are sent again, followed by the kept messages, in the order they were sent.
+// Kept messages include the ones that were still queued when the connection was lost. Requests might be delivered more than once
+// if the connection was lost after they were sent but before they were answered. Client connections resume their sessions automatically
+// when reconnecting (see Conn.SetReconnect), and likewise send the requests that are still pending again, unless the session is not resumed,
+// in which case the requests fail with ErrCodeDisconnected.
+// If the grace period expires, the connection is closed as usual and its pending requests fail with ErrCodeDisconnected.
+// Zero value (default) disables session resumption. This should be called before starting the server.
+func (s *Server) SetResumeGracePeriod(d time.Duration) {
+	s.resumeGrace = d
+}
+
+// ResumeToken returns the last resume token that the server issued for the client connection, if any.
+func (c *Conn) ResumeToken() string {
+	token, _ := c.resumeToken.Load().(string)
+	return token
+}
+
+// issueToken queues a new token for the connection to resume its session with. This is called before the underlying connection is set,
+// so that the token is the first message that the connection receives, letting reconnected clients know that their session is not resumed.
+func (s *Server) issueToken(c *Conn, ws *websocket.Conn) {
+	token, err := shortid.UUID()
+	if err == nil {
+		c.resumeToken.Store(token)
+		var data []byte
+		if data, err = c.Codec().Marshal(request{JSONRPC: jsonrpcVersion, Method: SessionMethod, Params: sessionParams{Token: token}}); err == nil {
+			err = c.enqueue(data, false)
+		}
+	}
+	if err != nil {
+		log.Printf("server: error sending resume token %v: %v, %v", c.ID, ws.RemoteAddr(), err)
+	}
+}
+
+// resumeSession resumes the suspended session with the new underlying connection, and receives messages until the connection is closed.
+func (s *Server) resumeSession(c *Conn, ws *websocket.Conn) {
+	log.Printf("server: client resumed session %v: %v", c.ID, ws.RemoteAddr())
+
+	token, err := shortid.UUID()
+	if err != nil {
+		log.Printf("server: error generating resume token %v: %v", c.ID, err)
+	}
+	c.SetCodec(s.connCodec(ws))
+	ac, _ := ws.Request().Context().Value(activityConnKey{}).(*activityConn)
+	if err := c.resume(ws, ac, token); err != nil {
+		log.Printf("server: error resuming session %v: %v, %v", c.ID, ws.RemoteAddr(), err)
+		s.endConn(c)
+		return
+	}
+	c.startReceive()
+	s.endConn(c)
+}
+
+// suspend keeps the session of the lost connection for the grace period, after which the connection is closed for good.
+// Connection is closed right away if the server is closed.
+func (s *Server) suspend(c *Conn) {
+	token := c.ResumeToken()
+	s.sessionsMutex.Lock()
+	if !s.running.Load().(bool) {
+		s.sessionsMutex.Unlock()
+		s.expire(c)
+		return
+	}
+	s.sessions[token] = &suspendedSession{conn: c, timer: time.AfterFunc(s.resumeGrace, func() {
+		if c := s.takeSession(token); c != nil {
+			log.Printf("server: session expired %v", c.ID)
+			s.expire(c)
+		}
+	})}
+	s.sessionsMutex.Unlock()
+	log.Printf("server: suspended session %v for %v", c.ID, s.resumeGrace)
+}
+
+// takeSession removes the suspended session with the given token and returns its connection, or nil if there is no such session.
+func (s *Server) takeSession(token string) *Conn {
+	if token == "" {
+		return nil
+	}
+
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	ss, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, token)
+	ss.timer.Stop()
+	return ss.conn
+}
+
+// expireSessions closes all the suspended sessions.
+func (s *Server) expireSessions() {
+	s.sessionsMutex.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*suspendedSession)
+	s.sessionsMutex.Unlock()
+
+	for _, ss := range sessions {
+		ss.timer.Stop()
+		s.expire(ss.conn)
+	}
+}
+
+// expire closes the suspended connection for good.
+func (s *Server) expire(c *Conn) {
+	c.finish()
+	s.endConn(c)
+}
+
+// suspend keeps the lost connection around to be resumed later, instead of closing it.
+// Messages sent from now on are kept to be sent upon resumption.
+func (c *Conn) suspend() {
+	c.missedMutex.Lock()
+	defer c.missedMutex.Unlock()
+	c.suspendSeq = c.seq.Load()
+	c.suspended.Store(true)
+	c.answered = cmap.New()
+	c.disconnect()
+
+	// messages queued for the lost connection are kept ahead of the ones sent from now on
+	c.missed = append(c.missed, c.takeQueued()...)
+}
+
+// takeQueued empties the send queue of the lost connection and returns the messages in it, except for requests,
+// which are sent again upon resumption from the pending requests list.
+func (c *Conn) takeQueued() [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case data := <-c.out:
+			c.queued.Add(-1)
+			if !c.isRequest(data) {
+				msgs = append(msgs, data)
+			}
+		default:
+			return msgs
+		}
+	}
+}
+
+// isRequest returns true if the encoded outgoing message is a request, which expects a response.
+func (c *Conn) isRequest(data []byte) bool {
+	var m message
+	return c.Codec().Unmarshal(data, &m) == nil && m.Method != "" && m.ID != nil
+}
+
+// addMissed keeps the message to be sent once the suspended connection is resumed.
+// Returns false if the connection is not suspended (anymore).
+func (c *Conn) addMissed(data []byte) (bool, error) {
+	c.missedMutex.Lock()
+	defer c.missedMutex.Unlock()
+	if !c.suspended.Load() {
+		return false, nil
+	}
+	if len(c.missed) >= cap(c.out) {
+		return true, ErrSendQueueFull
+	}
+	c.missed = append(c.missed, data)
+	return true, nil
+}
+
+// resume attaches the suspended connection to the new underlying connection. New resume token is sent first,
+// followed by the requests that are still pending and the messages that were sent while the connection was suspended, in order.
+func (c *Conn) resume(ws *websocket.Conn, ac *activityConn, token string) error {
+	// messages sent while setting the connection (i.e. from event handlers) are still added to the missed messages
+	if err := c.setConn(ws, ac); err != nil {
+		return err
+	}
+
+	c.missedMutex.Lock()
+	defer c.missedMutex.Unlock()
+
+	ps := c.pendingUntil(c.suspendSeq)
+	msgs := make([]interface{}, 0, len(ps)+1)
+	if token != "" {
+		c.resumeToken.Store(token)
+		msgs = append(msgs, request{JSONRPC: jsonrpcVersion, Method: SessionMethod, Params: sessionParams{Token: token, Resumed: true}})
+	}
+	for _, p := range ps {
+		msgs = append(msgs, p.msg)
+	}
+	for _, msg := range msgs {
+		data, err := c.Codec().Marshal(msg)
+		if err == nil {
+			err = c.enqueue(data, false)
+		}
+		if err != nil {
+			log.Printf("conn: error sending message upon resumption %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		}
+	}
+	for _, data := range c.missed {
+		// peer sends its pending requests again upon resumption, which should not be handled again if they are already answered
+		var m message
+		if c.Codec().Unmarshal(data, &m) == nil && m.Method == "" && m.ID != nil {
+			c.answered.Set(idString(m.ID), true)
+		}
+		if err := c.enqueue(data, false); err != nil {
+			log.Printf("conn: error sending message upon resumption %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		}
+	}
+
+	c.missed = nil
+	c.suspended.Store(false)
+	c.eventHandler(&Event{Type: EventResumed, Conn: c})
+	return nil
+}
+
+// isResent returns true if the incoming request is one that the peer sent again upon resumption of the session,
+// while it is still being handled or its response is already sent along with the messages kept during the suspension.
+func (c *Conn) isResent(m *message) bool {
+	if m.ID == nil {
+		return false
+	}
+	id := idString(m.ID)
+	if _, ok := c.answered.GetOk(id); ok {
+		c.answered.Delete(id)
+		return true
+	}
+	_, ok := c.reqCancels.GetOk(id)
+	return ok
+}
+
+// pendingUntil returns the pending requests which were sent before the one with the given sequence number, including it, in order.
+func (c *Conn) pendingUntil(seq uint64) []*pendingReq {
+	var ps []*pendingReq
+	c.resRoutes.Range(func(p interface{}) {
+		if p := p.(*pendingReq); p.seq <= seq {
+			ps = append(ps, p)
+		}
+	})
+	sort.Slice(ps, func(i, j int) bool { return ps[i].seq < ps[j].seq })
+	return ps
+}
+
+// handleSession keeps the resume token from the incoming SessionMethod notification, for client connections.
+// Pending requests that were kept while reconnecting are sent again if the session is resumed, as they might not have reached the server,
+// and fail with ErrCodeDisconnected otherwise.
+func (c *Conn) handleSession(m *message) {
+	var p sessionParams
+	if err := m.Params.unmarshal(&p); err != nil || p.Token == "" {
+		log.Printf("conn: received a malformed session message %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		c.failUnresumed()
+		return
+	}
+
+	c.resumeToken.Store(p.Token)
+	if !p.Resumed {
+		c.failUnresumed()
+	} else {
+		if c.awaitSession.Swap(false) {
+			for _, p := range c.pendingUntil(c.suspendSeq) {
+				data, err := c.Codec().Marshal(p.msg)
+				if err == nil {
+					err = c.enqueue(data, false)
+				}
+				if err != nil {
+					log.Printf("conn: error sending request upon resumption %v: %v, %v", c.ID, c.RemoteAddr(), err)
+				}
+			}
+		}
+		log.Printf("conn: resumed session %v: %v", c.ID, c.RemoteAddr())
+		c.eventHandler(&Event{Type: EventResumed, Conn: c})
+	}
+}
+
+// failUnresumed fails the pending requests that were kept while reconnecting, once it turns out that the session is not resumed.
+// Requests sent after reconnecting are not affected.
+func (c *Conn) failUnresumed() {
+	if !c.awaitSession.Swap(false) {
+		return
+	}
+
+	for _, p := range c.pendingUntil(c.suspendSeq) {
+		c.completePending(p, newResCtx(c, p.id, rawValue{}, &resError{Code: ErrCodeDisconnected, Message: "Connection closed before a response was received."}))
+	}
+}
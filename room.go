@@ -0,0 +1,72 @@
+package neptulon
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+var roomsCounter = expvar.NewInt("rooms")
+var roomMembersCounter = expvar.NewInt("roomMembers")
+
+// Join adds the connection denoted by the connection ID to the named room. Rooms are created as needed.
+// Connections are removed from all their rooms automatically once they are disconnected.
+func (s *Server) Join(connID, room string) error {
+	s.rooms.mutex.Lock()
+	defer s.rooms.mutex.Unlock()
+
+	// the check is done while holding the lock so that the connection cannot be removed from its rooms on disconnection in between
+	conn, ok := s.conns.GetOk(connID)
+	if !ok {
+		return fmt.Errorf("connection with requested ID: %v does not exist", connID)
+	}
+	s.rooms.join(conn.(*Conn), room)
+	return nil
+}
+
+// Leave removes the connection denoted by the connection ID from the named room. Rooms are removed once they are empty.
+// Returns an error if the connection is not in the room.
+func (s *Server) Leave(connID, room string) error {
+	s.rooms.mutex.Lock()
+	defer s.rooms.mutex.Unlock()
+	if !s.rooms.leave(connID, room) {
+		return fmt.Errorf("connection with requested ID: %v is not in room: %v", connID, room)
+	}
+	return nil
+}
+
+// Rooms returns the names of all the rooms with at least one connection, in sorted order.
+func (s *Server) Rooms() []string {
+	return s.rooms.names()
+}
+
+// RoomMembers returns the IDs of the connections in the named room, in sorted order.
+func (s *Server) RoomMembers(room string) []string {
+	return s.rooms.connIDs(room)
+}
+
+// ConnRooms returns the names of the rooms that the connection denoted by the connection ID is in, in sorted order.
+func (s *Server) ConnRooms(connID string) []string {
+	return s.rooms.groupsOf(connID)
+}
+
+// SendRoomNotification sends a JSON-RPC notification to all the connections in the named room.
+// See Multicast for details.
+func (s *Server) SendRoomNotification(room string, method string, params interface{}) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+
+	return notifyAll(s.rooms.conns(room), method, params)
+}
+
+// SendRoomRequest sends a JSON-RPC request to all the connections in the named room and collects their responses.
+// See MulticastRequest for details.
+func (s *Server) SendRoomRequest(ctx context.Context, room string, method string, params interface{}) (*BroadcastResult, error) {
+	if !s.running.Load().(bool) {
+		return nil, errors.New("use of closed server")
+	}
+
+	return requestAll(ctx, s.rooms.conns(room), method, params), nil
+}
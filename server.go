@@ -2,6 +2,7 @@
 package neptulon
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -14,6 +15,7 @@ import (
 	"net/url"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/neptulon/cmap"
 
@@ -24,25 +26,65 @@ var connsCounter = expvar.NewInt("conns")
 
 // Server is a Neptulon server.
 type Server struct {
-	addr           string
-	conns          *cmap.CMap // conn ID -> *Conn
-	middleware     []func(ctx *ReqCtx) error
-	listener       net.Listener
-	wsConfig       websocket.Config
-	wg             sync.WaitGroup
-	running        atomic.Value
-	disconnHandler func(c *Conn)
+	addr            string
+	conns           *cmap.CMap // conn ID -> *Conn
+	rooms           *groups    // room name -> conns
+	users           *groups    // user ID -> conns
+	subs            *groups    // topic pattern -> conns
+	backplane       Backplane
+	nodeID          string
+	remotePending   *cmap.CMap // request ID -> *remoteReq, for requests forwarded through the backplane
+	middleware      []func(ctx *ReqCtx) error
+	listener        net.Listener
+	listenerMutex   sync.Mutex
+	wsConfig        websocket.Config
+	wg              sync.WaitGroup
+	connWG          sync.WaitGroup // incremented by one per client connection, until all the goroutines of the connection exit
+	running         atomic.Value
+	strict          bool
+	shutdownNotice  bool
+	codecs          []Codec
+	sendQueueSize   int
+	streamWindow    int
+	maxMsgSize      int
+	limiter         *limiter
+	connLimit       int
+	connPolicy      SaturationPolicy
+	orderKey        func(ctx *ReqCtx) string
+	reqTimeout      time.Duration
+	resTimeout      time.Duration
+	pingInterval    time.Duration
+	idleTimeout     time.Duration
+	store           Store
+	resumeGrace     time.Duration
+	sessions        map[string]*suspendedSession // resume token -> suspended session
+	sessionsMutex   sync.Mutex
+	disconnHandler  func(c *Conn)
+	eventHandler    func(e *Event)
+	deliveryHandler func(req *StoredRequest, ctx *ResCtx)
 }
 
 // NewServer creates a new Neptulon server.
 // addr should be formatted as host:port (i.e. 127.0.0.1:3000)
 func NewServer(addr string) *Server {
 	s := &Server{
-		addr:           addr,
-		conns:          cmap.New(),
-		disconnHandler: func(c *Conn) {},
+		addr:            addr,
+		conns:           cmap.New(),
+		rooms:           newGroups(roomsCounter, roomMembersCounter),
+		users:           newGroups(usersCounter, userConnsCounter),
+		subs:            newGroups(topicsCounter, subscriptionsCounter),
+		sessions:        make(map[string]*suspendedSession),
+		sendQueueSize:   DefaultSendQueueSize,
+		streamWindow:    DefaultStreamWindow,
+		maxMsgSize:      DefaultMaxMessageSize,
+		codecs:          []Codec{JSONCodec},
+		pingInterval:    DefaultPingInterval,
+		idleTimeout:     DefaultIdleTimeout,
+		disconnHandler:  func(c *Conn) {},
+		eventHandler:    func(e *Event) {},
+		deliveryHandler: func(req *StoredRequest, ctx *ResCtx) {},
 	}
-	s.running.Store(false)
+	s.running.Store(true)
 	return s
 }
 
@@ -76,6 +118,116 @@ func (s *Server) UseTLS(cert, privKey, clientCACert []byte) error {
 	return nil
 }
 
+// SetSendQueueSize sets the outbound message queue size for all client connections.
+// See Conn.SetSendQueueSize for details.
+func (s *Server) SetSendQueueSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("server: send queue size must be at least 1, got: %v", size)
+	}
+	s.sendQueueSize = size
+	return nil
+}
+
+// SetStreamWindow sets the stream window for all client connections.
+// See Conn.SetStreamWindow for details.
+func (s *Server) SetStreamWindow(size int) error {
+	if size < 1 {
+		return fmt.Errorf("server: stream window must be at least 1, got: %v", size)
+	}
+	s.streamWindow = size
+	return nil
+}
+
+// SetMaxMessageSize sets the maximum size of incoming messages for all client connections.
+// See Conn.SetMaxMessageSize for details.
+func (s *Server) SetMaxMessageSize(size int) {
+	s.maxMsgSize = size
+}
+
+// SetConcurrency limits the total number of incoming requests that are handled concurrently across all client connections.
+// Policy determines what happens to further incoming requests once the limit is reached.
+// This should be called before starting the server. Zero limit (default) means no limit.
+func (s *Server) SetConcurrency(limit int, policy SaturationPolicy) {
+	s.limiter = newLimiter(limit, policy)
+}
+
+// SetConnConcurrency limits the number of incoming requests that are handled concurrently for each client connection.
+// See Conn.SetConcurrency for details.
+func (s *Server) SetConnConcurrency(limit int, policy SaturationPolicy) {
+	s.connLimit = limit
+	s.connPolicy = policy
+}
+
+// SetOrdered makes all client connections handle their incoming requests strictly in arrival order, one at a time.
+// See Conn.SetOrdered for details.
+func (s *Server) SetOrdered(ordered bool) {
+	if ordered {
+		s.orderKey = orderAll
+	} else {
+		s.orderKey = nil
+	}
+}
+
+// SetOrderKey makes all client connections handle their incoming requests that share the same order key strictly in arrival order.
+// See Conn.SetOrderKey for details.
+func (s *Server) SetOrderKey(keyFn func(ctx *ReqCtx) string) {
+	s.orderKey = keyFn
+}
+
+// SetRequestTimeout sets the duration after which the context of an incoming request is canceled.
+// See Conn.SetRequestTimeout for details.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.reqTimeout = timeout
+}
+
+// SetResponseTimeout sets the default duration to wait for a response to a request sent to a client connection.
+// See Conn.SetResponseTimeout for details.
+func (s *Server) SetResponseTimeout(timeout time.Duration) {
+	s.resTimeout = timeout
+}
+
+// SetPingInterval sets the interval between WebSocket pings sent through client connections.
+// See Conn.SetPingInterval for details.
+func (s *Server) SetPingInterval(interval time.Duration) {
+	s.pingInterval = interval
+}
+
+// SetIdleTimeout sets the duration after which client connections are closed if nothing is received from them.
+// See Conn.SetIdleTimeout for details.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetStrict enables or disables strict JSON-RPC 2.0 mode for all client connections.
+// See Conn.SetStrict for details.
+func (s *Server) SetStrict(strict bool) {
+	s.strict = strict
+}
+
+// SetShutdownNotice enables or disables sending a ShutdownMethod notification to all client connections when Shutdown is called.
+// Disabled by default.
+func (s *Server) SetShutdownNotice(notify bool) {
+	s.shutdownNotice = notify
+}
+
+// SetCodec sets the codec used to encode and decode messages for all client connections.
+// See SetCodecs for details.
+func (s *Server) SetCodec(codec Codec) {
+	s.SetCodecs(codec)
+}
+
+// SetCodecs sets the codecs supported by the server, which are advertised as WebSocket subprotocols (i.e. "jsonrpc.msgpack").
+// Each client connection uses the first of its requested subprotocols that the server supports, and connections
+// requesting only unsupported subprotocols are rejected. Connections that do not request any subprotocols use the first codec.
+// Default is JSONCodec only. This should be called before starting the server. Returns an error if no codecs are given.
+func (s *Server) SetCodecs(codecs ...Codec) error {
+	if len(codecs) == 0 {
+		return errors.New("server: at least one codec must be given")
+	}
+	s.codecs = codecs
+	return nil
+}
+
 // Middleware registers middleware to handle incoming request messages.
 func (s *Server) Middleware(middleware ...Middleware) {
 	for _, m := range middleware {
@@ -89,40 +241,83 @@ func (s *Server) MiddlewareFunc(middleware ...func(ctx *ReqCtx) error) {
 }
 
 // DisconnHandler registers a function to handle client disconnection events.
+// Disconnection reason is available through Conn.DisconnReason and Conn.Err.
 func (s *Server) DisconnHandler(handler func(c *Conn)) {
 	s.disconnHandler = handler
 }
 
-// ListenAndServe starts the Neptulon server. This function blocks until server is closed.
-func (s *Server) ListenAndServe() error {
-	mux := http.NewServeMux()
-	mux.Handle("/", websocket.Server{
-		Config:  s.wsConfig,
-		Handler: s.wsConnHandler,
-		Handshake: func(config *websocket.Config, req *http.Request) error {
-			s.wg.Add(1)                                  // todo: this needs to happen inside the gorotune executing the Start method and not the request goroutine or we'll miss some edge connections
-			config.Origin, _ = url.Parse(req.RemoteAddr) // we're interested in remote address and not origin header text
-			return nil
-		},
-	})
+// EventHandler registers a function to handle lifecycle events of all client connections.
+// See Conn.EventHandler for details.
+func (s *Server) EventHandler(handler func(e *Event)) {
+	s.eventHandler = handler
+}
 
+// ListenAndServe starts the Neptulon server on the server address. This function blocks until server is closed.
+func (s *Server) ListenAndServe() error {
 	l, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to create TLS listener on network address %v with error: %v", s.addr, err)
 	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts incoming WebSocket connections on the given listener, at any path. This function blocks until server is closed.
+// Server takes the ownership of the listener and closes it when the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.running.Load().(bool) {
+		l.Close()
+		return errors.New("use of closed server")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	s.listenerMutex.Lock()
 	s.listener = l
+	s.listenerMutex.Unlock()
 
-	log.Printf("server: started %v", s.addr)
-	s.running.Store(true)
-	err = http.Serve(l, mux)
+	log.Printf("server: started %v", l.Addr())
+	err := http.Serve(l, mux)
 	if !s.running.Load().(bool) {
 		return nil
 	}
 	return err
 }
 
+// ServeHTTP upgrades the HTTP request to a WebSocket connection and handles it as a client connection,
+// so that the server can be mounted on an existing HTTP server at any path, i.e. mux.Handle("/ws", s).
+// This method blocks until the client connection is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	activityHandler(websocket.Server{
+		Config:    s.wsConfig,
+		Handler:   s.wsConnHandler,
+		Handshake: s.handshake,
+	}).ServeHTTP(w, req)
+}
+
+// handshake picks the codec for an incoming WebSocket connection and rejects it if the server is closed.
+func (s *Server) handshake(config *websocket.Config, req *http.Request) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+	if len(config.Protocol) > 0 {
+		codec := s.pickCodec(config.Protocol)
+		if codec == nil {
+			return fmt.Errorf("server: none of the requested subprotocols are supported: %v", config.Protocol)
+		}
+		config.Protocol = []string{subprotocol(codec)}
+	}
+	s.wg.Add(1)                                  // todo: this needs to happen inside the gorotune executing the Start method and not the request goroutine or we'll miss some edge connections
+	config.Origin, _ = url.Parse(req.RemoteAddr) // we're interested in remote address and not origin header text
+	return nil
+}
+
 // SendRequest sends a JSON-RPC request through the connection denoted by the connection ID with an auto generated request ID.
 // resHandler is called when a response is returned.
+// If the connection is not on this server and the server is connected to a backplane, the request is forwarded to the other nodes.
+// In that case, response context does not have a connection, and if none of the nodes have the connection,
+// resHandler is called with an ErrCodeDisconnected error response once all the nodes reply so.
+// If there are no other nodes, an error is returned right away.
 func (s *Server) SendRequest(connID string, method string, params interface{}, resHandler func(ctx *ResCtx) error) (reqID string, err error) {
 	if !s.running.Load().(bool) {
 		return "", errors.New("use of closed server")
@@ -134,6 +329,27 @@ func (s *Server) SendRequest(connID string, method string, params interface{}, r
 		log.Printf("server: send-request: connID: %v, reqID: %v, method: %v, params: %#v, err (if any): %v", connID, reqID, method, params, err)
 		return
 	}
+	if s.backplane != nil {
+		return s.forwardRequest(context.Background(), connID, method, params, resHandler)
+	}
+
+	return "", fmt.Errorf("connection with requested ID: %v does not exist", connID)
+}
+
+// SendRequestContext sends a JSON-RPC request through the connection denoted by the connection ID with an auto generated request ID.
+// resHandler is called when a response is returned, or when the context is done. See Conn.SendRequestContext for details.
+// Requests to connections on other nodes are forwarded through the backplane, if any. See SendRequest for details.
+func (s *Server) SendRequestContext(ctx context.Context, connID string, method string, params interface{}, resHandler func(ctx *ResCtx) error) (reqID string, err error) {
+	if !s.running.Load().(bool) {
+		return "", errors.New("use of closed server")
+	}
+
+	if conn, ok := s.conns.GetOk(connID); ok {
+		return conn.(*Conn).SendRequestContext(ctx, method, params, resHandler)
+	}
+	if s.backplane != nil {
+		return s.forwardRequest(ctx, connID, method, params, resHandler)
+	}
 
 	return "", fmt.Errorf("connection with requested ID: %v does not exist", connID)
 }
@@ -144,18 +360,62 @@ func (s *Server) SendRequestArr(connID string, method string, resHandler func(ct
 	return s.SendRequest(connID, method, params, resHandler)
 }
 
-// Close closes the network listener and the active connections.
+// SendBatch sends a batch of JSON-RPC requests and/or notifications through the connection denoted by the connection ID, in a single message.
+// See Conn.SendBatch for details.
+func (s *Server) SendBatch(connID string, reqs ...BatchRequest) (reqIDs []string, err error) {
+	if !s.running.Load().(bool) {
+		return nil, errors.New("use of closed server")
+	}
+
+	if conn, ok := s.conns.GetOk(connID); ok {
+		return conn.(*Conn).SendBatch(reqs...)
+	}
+
+	return nil, fmt.Errorf("connection with requested ID: %v does not exist", connID)
+}
+
+// SendNotification sends a JSON-RPC notification through the connection denoted by the connection ID.
+// If the connection is not on this server and the server is connected to a backplane, the notification is forwarded to the other nodes.
+func (s *Server) SendNotification(connID string, method string, params interface{}) error {
+	if !s.running.Load().(bool) {
+		return errors.New("use of closed server")
+	}
+
+	if conn, ok := s.conns.GetOk(connID); ok {
+		return conn.(*Conn).SendNotification(method, params)
+	}
+	if s.backplane != nil {
+		return s.forwardNotification(connID, method, params)
+	}
+
+	return fmt.Errorf("connection with requested ID: %v does not exist", connID)
+}
+
+// SendNotificationArr sends a JSON-RPC notification through the connection denoted by the connection ID, with array params.
+func (s *Server) SendNotificationArr(connID string, method string, params ...interface{}) error {
+	return s.SendNotification(connID, method, params)
+}
+
+// Close closes the network listener (if any) and the active connections.
+// Server cannot be used once it is closed, including as an HTTP handler.
 func (s *Server) Close() error {
 	if !s.running.Load().(bool) {
 		return nil
 	}
 	s.running.Store(false)
-	err := s.listener.Close()
+	var err error
+	s.listenerMutex.Lock()
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.listenerMutex.Unlock()
 
 	// close all active connections discarding any read/writes that is going on currently
+	s.expireSessions()
 	s.conns.Range(func(c interface{}) {
 		c.(*Conn).Close()
 	})
+	s.closeBackplane()
 
 	if err != nil {
 		return fmt.Errorf("an error occured before or while stopping the server: %v", err)
@@ -166,30 +426,188 @@ func (s *Server) Close() error {
 	return nil
 }
 
-// Wait waits for all message/connection handler goroutines in all connections to exit.
-func (s *Server) Wait() {
-	s.conns.Range(func(c interface{}) {
-		c.(*Conn).Wait(180)
-	})
+// Shutdown gracefully shuts down the server. It stops accepting new connections, sends a ShutdownMethod notification
+// to all client connections if enabled with SetShutdownNotice, and waits for the requests that are being handled to
+// complete and their responses to be written. Further incoming requests are rejected with ErrCodeShuttingDown error responses.
+// Each connection is closed as soon as it is drained. If the context is done before all the connections are drained,
+// the remaining connections are closed right away and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.running.Load().(bool) {
+		return nil
+	}
+	s.running.Store(false)
+	log.Printf("server: shutting down %v", s.addr)
+
+	var err error
+	s.listenerMutex.Lock()
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.listenerMutex.Unlock()
+	if err != nil {
+		err = fmt.Errorf("an error occured while closing the listener: %v", err)
+	}
+
+	// suspended sessions have nothing to drain
+	s.expireSessions()
+	conns := s.connsWhere(nil)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		if s.shutdownNotice {
+			if err := c.SendNotification(ShutdownMethod, nil); err != nil {
+				log.Printf("server: error sending shutdown notification %v: %v, %v", c.ID, c.RemoteAddr(), err)
+			}
+		}
+
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.drain(ctx)
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+
+	// backplane is closed only after draining, as responses to forwarded requests are sent back through it
+	s.closeBackplane()
+
+	// wait for connection handler goroutines to exit
+	done := make(chan struct{})
+	go func() { s.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Printf("server: stopped %v", s.addr)
+	return err
+}
+
+// closeBackplane disconnects the server from the backplane, if any.
+func (s *Server) closeBackplane() {
+	if s.backplane == nil {
+		return
+	}
+	if err := s.backplane.Close(); err != nil {
+		log.Printf("server: error closing backplane: %v", err)
+	}
+}
+
+// Wait waits for all message/connection handler goroutines in all connections to exit, including the request handlers
+// that are still running after their connections are closed. This should be called after Close, as open connections are waited for as well.
+// If the context is done before then, Wait returns the context error.
+func (s *Server) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() { s.connWG.Wait(); close(done) }()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pickCodec returns the codec for the first of the given subprotocols that the server supports, or nil if there is none.
+func (s *Server) pickCodec(protocols []string) Codec {
+	for _, p := range protocols {
+		if codec := codecBySubprotocol(s.codecs, p); codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+// handleEvent handles the lifecycle events of client connections, and passes them on to the registered event handler.
+func (s *Server) handleEvent(e *Event) {
+	if e.Type == EventAuthenticated {
+		if userID, ok := e.Conn.Session.Get("userid").(string); ok {
+			s.setUser(e.Conn, userID)
+			if s.store != nil {
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					s.replayStored(e.Conn, userID)
+				}()
+			}
+		}
+	}
+	s.eventHandler(e)
 }
 
 // wsHandler handles incoming websocket connections.
 func (s *Server) wsConnHandler(ws *websocket.Conn) {
+	if c := s.takeSession(ws.Request().Header.Get(ResumeHeader)); c != nil {
+		defer recoverAndLog(c, &s.wg)
+		s.resumeSession(c, ws)
+		return
+	}
+
 	c, err := NewConn()
 	if err != nil {
 		log.Printf("server: error while accepting connection: %v", err)
 		return
 	}
+	s.connWG.Add(1)
 	defer recoverAndLog(c, &s.wg)
 	c.MiddlewareFunc(s.middleware...)
+	c.MiddlewareFunc(s.handleSubscriptions)
+	c.SetStrict(s.strict)
+	c.SetCodec(s.connCodec(ws))
+	c.SetSendQueueSize(s.sendQueueSize)
+	c.SetStreamWindow(s.streamWindow)
+	c.SetMaxMessageSize(s.maxMsgSize)
+	c.SetConcurrency(s.connLimit, s.connPolicy)
+	c.srvLimiter = s.limiter
+	c.SetOrderKey(s.orderKey)
+	c.SetRequestTimeout(s.reqTimeout)
+	c.SetResponseTimeout(s.resTimeout)
+	c.SetPingInterval(s.pingInterval)
+	c.SetIdleTimeout(s.idleTimeout)
+	c.EventHandler(s.handleEvent)
+	c.resumable = s.resumeGrace > 0
 
 	log.Printf("server: client connected %v: %v", c.ID, ws.RemoteAddr())
 
 	s.conns.Set(c.ID, c)
 	connsCounter.Add(1)
-	c.setConn(ws)
+	ac, _ := ws.Request().Context().Value(activityConnKey{}).(*activityConn)
+	if c.resumable {
+		s.issueToken(c, ws)
+	}
+	c.setConn(ws, ac)
 	c.startReceive()
+	s.endConn(c)
+}
+
+// connCodec returns the codec for the connection according to the subprotocol picked during the handshake.
+func (s *Server) connCodec(ws *websocket.Conn) Codec {
+	if p := ws.Config().Protocol; len(p) == 1 {
+		return s.pickCodec(p)
+	}
+	return s.codecs[0]
+}
+
+// endConn removes the connection from the server once it is closed, or suspends it if it can be resumed.
+func (s *Server) endConn(c *Conn) {
+	if c.suspended.Load() {
+		s.suspend(c)
+		return
+	}
+
 	s.conns.Delete(c.ID)
+	s.rooms.leaveAll(c.ID)
+	s.users.leaveAll(c.ID)
+	s.subs.leaveAll(c.ID)
 	connsCounter.Add(-1)
 	s.disconnHandler(c)
+
+	// request handlers of the connection might still be running
+	go func() {
+		c.wg.Wait()
+		s.connWG.Done()
+	}()
 }
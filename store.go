@@ -0,0 +1,173 @@
+package neptulon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StoredRequest is a request stored for a user until it is answered by one of the user's connections.
+type StoredRequest struct {
+	ID     string          `json:"id"`               // Stored request ID, which is not the same as the JSON-RPC request ID.
+	UserID string          `json:"userId"`           // Recipient user ID.
+	Method string          `json:"method"`           // Called method.
+	Params json.RawMessage `json:"params,omitempty"` // Request parameters.
+	Time   time.Time       `json:"time"`             // Time the request was stored.
+}
+
+// Store persists the requests sent with Server.DeliverToUser until they are answered.
+// Implementations should be safe for concurrent use.
+type Store interface {
+	// Add stores the request.
+	Add(req *StoredRequest) error
+
+	// Get returns all the stored requests of the user, in the order they were added.
+	Get(userID string) ([]*StoredRequest, error)
+
+	// Remove removes the request with the given ID. Returns false if there is no such request (i.e. it was already removed).
+	Remove(userID, id string) (bool, error)
+}
+
+// MemoryStore is an in-memory Store. Stored requests are lost when the process exits.
+type MemoryStore struct {
+	mutex sync.Mutex
+	reqs  map[string][]*StoredRequest // user ID -> requests
+}
+
+// NewMemoryStore creates a new in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{reqs: make(map[string][]*StoredRequest)}
+}
+
+// Add stores the request.
+func (s *MemoryStore) Add(req *StoredRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reqs[req.UserID] = append(s.reqs[req.UserID], req)
+	return nil
+}
+
+// Get returns all the stored requests of the user, in the order they were added.
+func (s *MemoryStore) Get(userID string) ([]*StoredRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*StoredRequest(nil), s.reqs[userID]...), nil
+}
+
+// Remove removes the request with the given ID.
+func (s *MemoryStore) Remove(userID, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reqs, ok := removeStored(s.reqs[userID], id)
+	if !ok {
+		return false, nil
+	}
+	if len(reqs) == 0 {
+		delete(s.reqs, userID)
+	} else {
+		s.reqs[userID] = reqs
+	}
+	return true, nil
+}
+
+// FileStore is a Store which keeps the requests of each user in a JSON file in a directory, so that they survive restarts.
+type FileStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// NewFileStore creates a new file-backed store in the given directory, creating the directory if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Add stores the request.
+func (s *FileStore) Add(req *StoredRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reqs, err := s.read(req.UserID)
+	if err != nil {
+		return err
+	}
+	return s.write(req.UserID, append(reqs, req))
+}
+
+// Get returns all the stored requests of the user, in the order they were added.
+func (s *FileStore) Get(userID string) ([]*StoredRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read(userID)
+}
+
+// Remove removes the request with the given ID.
+func (s *FileStore) Remove(userID, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reqs, err := s.read(userID)
+	if err != nil {
+		return false, err
+	}
+	reqs, ok := removeStored(reqs, id)
+	if !ok {
+		return false, nil
+	}
+	return true, s.write(userID, reqs)
+}
+
+// path returns the file path for the user. User ID is hex encoded since it might contain characters that are not valid in file names.
+func (s *FileStore) path(userID string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(userID))+".json")
+}
+
+func (s *FileStore) read(userID string) ([]*StoredRequest, error) {
+	data, err := os.ReadFile(s.path(userID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []*StoredRequest
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// write replaces the file of the user atomically, or removes it if there are no requests left.
+func (s *FileStore) write(userID string, reqs []*StoredRequest) error {
+	path := s.path(userID)
+	if len(reqs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(reqs)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeStored removes the request with the given ID from the list. Returns false if there is no such request.
+func removeStored(reqs []*StoredRequest, id string) ([]*StoredRequest, bool) {
+	for i, r := range reqs {
+		if r.ID == id {
+			return append(reqs[:i:i], reqs[i+1:]...), true
+		}
+	}
+	return reqs, false
+}
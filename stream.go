@@ -0,0 +1,295 @@
+package neptulon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/neptulon/shortid"
+)
+
+// DefaultStreamWindow is the default number of chunks that the handler of a streaming request can send ahead of the ones read by the caller.
+const DefaultStreamWindow = 16
+
+// maxOpenStreams is the maximum number of streaming requests from the peer that are in flight or about to be sent,
+// beyond which stream windows opened for new requests are ignored.
+const maxOpenStreams = 1024
+
+// ErrNotStreaming is returned by ReqCtx.SendChunk when the caller did not send the request with Conn.Stream.
+var ErrNotStreaming = errors.New("ctx: caller did not request a streaming response")
+
+// Reserved method names for the streaming response messages.
+const (
+	// StreamMethod is the reserved method name for the notifications carrying the chunks of a streaming response.
+	// Notification params are in the form {"id": <ID of the streaming request>, "data": <chunk>}.
+	// Request handlers send chunks with ReqCtx.SendChunk, and callers read them with Conn.Stream.
+	StreamMethod = "$/stream"
+
+	// StreamAckMethod is the reserved method name for the notifications that allow the handler of a streaming request to send more chunks.
+	// Notification params are in the form {"id": <ID of the streaming request>, "n": <number of chunks>, "open": <true for the first one>}.
+	// Conn.Stream opens the stream by allowing a window of chunks right before sending the request, and allows more as the chunks are read.
+	// Requests which are not preceded by an opening acknowledgement do not get a streaming response.
+	StreamAckMethod = "$/streamAck"
+)
+
+// Outgoing StreamMethod notification params.
+type chunkParams struct {
+	ID   json.RawMessage `json:"id"`
+	Data interface{}     `json:"data"`
+}
+
+// Incoming StreamMethod notification params.
+type streamChunk struct {
+	ID   json.RawMessage `json:"id"`
+	Data rawValue        `json:"data"` // in the wire format
+}
+
+// StreamAckMethod notification params.
+type ackParams struct {
+	ID   json.RawMessage `json:"id"`
+	N    int             `json:"n"`
+	Open bool            `json:"open,omitempty"` // set for the acknowledgement sent before the request
+}
+
+// SetStreamWindow sets the number of chunks that the handler of a streaming request sent with Stream can send ahead of the ones read
+// with Stream.Next, after which the handler blocks until more chunks are read. Size should be at least 1. Default value is DefaultStreamWindow.
+func (c *Conn) SetStreamWindow(size int) error {
+	if size < 1 {
+		return fmt.Errorf("conn: stream window must be at least 1, got: %v", size)
+	}
+	c.streamWindow = size
+	return nil
+}
+
+// SendChunk sends a chunk of data to the peer as a part of a streaming response, before the final response is returned with Res or Err.
+// Chunks are read in order by the caller with Conn.Stream. SendChunk blocks while the caller has not read enough of the chunks
+// that were already sent, and returns the context error if the request is canceled in the meantime.
+// Returns ErrNotStreaming right away if the request was not sent with Conn.Stream, i.e. with SendRequest or Call.
+func (ctx *ReqCtx) SendChunk(data interface{}) error {
+	if ctx.notification {
+		return errors.New("ctx: cannot send chunks for notifications")
+	}
+	if ctx.credits == nil {
+		return ErrNotStreaming
+	}
+	if err := ctx.credits.acquire(ctx.Context()); err != nil {
+		return err
+	}
+	return ctx.Conn.SendNotification(StreamMethod, chunkParams{ID: ctx.rawID, Data: data})
+}
+
+// streamCredits counts the chunks that the handler of a streaming request is allowed to send.
+type streamCredits struct {
+	mutex sync.Mutex
+	n     int
+	grant chan struct{} // signaled when more chunks are allowed
+}
+
+func newStreamCredits() *streamCredits {
+	return &streamCredits{grant: make(chan struct{}, 1)}
+}
+
+// add allows n more chunks to be sent.
+func (s *streamCredits) add(n int) {
+	s.mutex.Lock()
+	s.n += n
+	s.mutex.Unlock()
+	select {
+	case s.grant <- struct{}{}:
+	default:
+	}
+}
+
+// acquire takes the permission to send a chunk, blocking until there is one or the context is done.
+func (s *streamCredits) acquire(ctx context.Context) error {
+	for {
+		s.mutex.Lock()
+		if s.n > 0 {
+			s.n--
+			s.mutex.Unlock()
+			return nil
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-s.grant:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stream is a streaming request sent with Conn.Stream. Stream is not safe for concurrent use.
+type Stream struct {
+	ID string // Request ID.
+
+	conn   *Conn
+	rawID  json.RawMessage
+	chunks chan rawValue // received chunks which are not read yet
+	chunk  rawValue      // last chunk read with Next
+	acks   int           // number of chunks read but not yet acknowledged
+	window int
+	res    *ResCtx
+	done   chan struct{} // closed when the final response is received
+	cancel context.CancelFunc
+}
+
+// Stream sends a JSON-RPC request through the connection to a handler which responds with a stream of chunks (see ReqCtx.SendChunk)
+// followed by a final response. Chunks are read in order with Next and Chunk, and the final response with Result.
+// Handler can send up to the stream window of chunks (see SetStreamWindow) ahead of the ones that are read, after which it blocks.
+// If the given context is done or the stream is closed with Close before the final response is received, the peer is sent
+// a request cancellation message and the stream ends with an ErrCodeCanceled or ErrCodeTimeout error response.
+// Stream should always be closed once done with it.
+func (c *Conn) Stream(ctx context.Context, method string, params interface{}) (*Stream, error) {
+	id, err := shortid.UUID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		ID:     id,
+		conn:   c,
+		chunks: make(chan rawValue, c.streamWindow),
+		window: c.streamWindow,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	s.rawID, _ = json.Marshal(id)
+
+	// stream is opened before sending the request, so that the handler knows that a streaming response is requested
+	c.streams.Set(id, s)
+	if err := c.SendNotification(StreamAckMethod, ackParams{ID: s.rawID, N: s.window, Open: true}); err != nil {
+		c.streams.Delete(id)
+		cancel()
+		return nil, err
+	}
+
+	err = c.sendRequestID(ctx, id, method, params, c.resTimeout, func(res *ResCtx) error {
+		c.streams.Delete(res.ID)
+		s.res = res
+		close(s.done)
+		return nil
+	})
+	if err != nil {
+		c.streams.Delete(id)
+		c.sendCancel(id)
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next waits for the next chunk and returns true, or returns false once the final response is received and all the chunks are read.
+// Handler of the request is allowed to send more chunks as the chunks are read.
+func (s *Stream) Next() bool {
+	select {
+	case s.chunk = <-s.chunks:
+	case <-s.done:
+		// all the chunks are received before the final response
+		select {
+		case s.chunk = <-s.chunks:
+		default:
+			s.chunk = rawValue{}
+			return false
+		}
+	}
+
+	s.acks++
+	if s.acks < (s.window+1)/2 {
+		return true
+	}
+	select {
+	case <-s.done:
+		return true
+	default:
+	}
+	if err := s.conn.SendNotification(StreamAckMethod, ackParams{ID: s.rawID, N: s.acks}); err != nil {
+		log.Printf("conn: error sending stream acknowledgement %v: %v, %v", s.conn.ID, s.conn.RemoteAddr(), err)
+	}
+	s.acks = 0
+	return true
+}
+
+// Chunk reads the last chunk read with Next into given object.
+// Object should be passed by reference.
+func (s *Stream) Chunk(v interface{}) error {
+	if s.chunk.data == nil {
+		return errors.New("conn: no chunk to read since Next did not return one")
+	}
+
+	if err := s.chunk.unmarshal(v); err != nil {
+		return fmt.Errorf("conn: cannot deserialize stream chunk: %v", err)
+	}
+	return nil
+}
+
+// Result waits for the final response and decodes its result into result, which should be passed by reference, unless it is nil.
+// If an error response is returned, the returned error is of type *CallError carrying the JSON-RPC error details.
+// Result should be called after Next returns false, as the handler might be waiting for the chunks to be read before returning.
+func (s *Stream) Result(result interface{}) error {
+	<-s.done
+	if !s.res.Success {
+		return &CallError{Code: s.res.ErrorCode, Message: s.res.ErrorMessage, Data: s.res.errorData}
+	}
+	if result != nil {
+		return s.res.Result(result)
+	}
+	return nil
+}
+
+// Close abandons the stream if the final response is not received yet, letting the peer know that we are no longer interested in it.
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// handleChunk queues the chunk in the incoming StreamMethod notification to be read from its stream.
+func (c *Conn) handleChunk(m *message) {
+	var p streamChunk
+	if err := m.Params.unmarshal(&p); err != nil {
+		log.Printf("conn: received a malformed stream chunk %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		return
+	}
+
+	s, ok := c.streams.GetOk(idString(p.ID))
+	if !ok {
+		log.Printf("conn: ignoring chunk of a stream with unknown ID %v: %v, %s", c.ID, c.RemoteAddr(), p.ID)
+		return
+	}
+
+	select {
+	case s.(*Stream).chunks <- p.Data:
+	default:
+		log.Printf("conn: peer exceeded the stream window, canceling stream %v: %v, %s", c.ID, c.RemoteAddr(), p.ID)
+		s.(*Stream).cancel()
+	}
+}
+
+// handleStreamAck allows the handler of the in-flight request denoted by the incoming StreamAckMethod notification to send more chunks.
+// Opening acknowledgements allow the handler of the request that is about to be received to send a streaming response.
+func (c *Conn) handleStreamAck(m *message) {
+	var p ackParams
+	if err := m.Params.unmarshal(&p); err != nil || p.N <= 0 {
+		log.Printf("conn: received a malformed stream acknowledgement %v: %v, %v", c.ID, c.RemoteAddr(), err)
+		return
+	}
+
+	id := idString(p.ID)
+	credits, ok := c.reqStreams.GetOk(id)
+	if !ok {
+		if !p.Open {
+			return
+		}
+		if c.reqStreams.Len() >= maxOpenStreams {
+			log.Printf("conn: ignoring stream opened beyond the limit of %v streams %v: %v, %s", maxOpenStreams, c.ID, c.RemoteAddr(), p.ID)
+			return
+		}
+		credits = newStreamCredits()
+		c.reqStreams.Set(id, credits)
+	}
+	credits.(*streamCredits).add(p.N)
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+)
+
+func TestMemoryBackplane(t *testing.T) {
+	hub := neptulon.NewMemoryHub()
+	testBackplane(t, hub.Backplane(), hub.Backplane())
+}
+
+func TestTCPBackplane(t *testing.T) {
+	b1, b2 := neptulon.NewTCPBackplane("127.0.0.1:4001", "127.0.0.1:4002"), neptulon.NewTCPBackplane("127.0.0.1:4002", "127.0.0.1:4001")
+	b1.SetSecret("secret")
+	b2.SetSecret("secret")
+	testBackplane(t, b1, b2)
+}
+
+func TestTCPBackplaneSecret(t *testing.T) {
+	if err := neptulon.NewTCPBackplane("127.0.0.1:4003").Start("node", func(data []byte) {}); err == nil {
+		t.Fatal("expected backplane without a secret not to start")
+	}
+
+	b1, b2 := neptulon.NewTCPBackplane("127.0.0.1:4003", "127.0.0.1:4004"), neptulon.NewTCPBackplane("127.0.0.1:4004", "127.0.0.1:4003")
+	b1.SetSecret("secret")
+	b2.SetSecret("other secret")
+	got := make(chan []byte, 1)
+	if err := b1.Start("node1", func(data []byte) { got <- data }); err != nil {
+		t.Fatal(err)
+	}
+	defer b1.Close()
+	if err := b2.Start("node2", func(data []byte) { got <- data }); err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+
+	time.Sleep(time.Millisecond * 300)
+	if n, _ := b1.Broadcast([]byte("hi")); n != 0 {
+		t.Fatalf("expected node with a different secret to be rejected, sent to: %v", n)
+	}
+	if err := b2.Send("node1", []byte("hi")); err == nil {
+		t.Fatal("expected node with a different secret to be rejected")
+	}
+	select {
+	case data := <-got:
+		t.Fatalf("expected no messages, got: %s", data)
+	default:
+	}
+}
+
+// testBackplane connects two servers through the given backplanes and routes messages from the first to a client of the second.
+func testBackplane(t *testing.T, b1, b2 neptulon.Backplane) {
+	sh1, sh2 := NewServerHelper(t), NewServerHelperAddr(t, host+":3002")
+	for _, sh := range []*ServerHelper{sh1, sh2} {
+		sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+			if ctx.Method == "whoami" {
+				ctx.Res = ctx.Conn.ID
+			}
+			return ctx.Next()
+		})
+	}
+	if err := sh1.Server.SetBackplane(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh2.Server.SetBackplane(b2); err != nil {
+		t.Fatal(err)
+	}
+	defer sh1.ListenAndServe().CloseWait()
+	defer sh2.ListenAndServe().CloseWait()
+
+	got := make(chan string, 10)
+	ch1 := sh1.GetConnHelper()
+	ch1.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		got <- "1:" + ctx.Method
+		return ctx.Next()
+	})
+	defer ch1.Connect().CloseWait()
+
+	ch2 := sh2.GetConnHelper()
+	ch2.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "ping" {
+			ctx.Res = "pong"
+		} else {
+			got <- "2:" + ctx.Method
+		}
+		return ctx.Next()
+	})
+	defer ch2.Connect().CloseWait()
+
+	bg := context.Background()
+	var connID string
+	if err := ch2.Conn.Call(bg, "whoami", nil, &connID); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(msgs ...string) {
+		recv := make(map[string]bool)
+		for range msgs {
+			select {
+			case m := <-got:
+				recv[m] = true
+			case <-time.After(time.Second):
+				t.Fatalf("expected messages: %v, got: %v", msgs, recv)
+			}
+		}
+		for _, m := range msgs {
+			if !recv[m] {
+				t.Fatalf("expected messages: %v, got: %v", msgs, recv)
+			}
+		}
+	}
+
+	// request to a connection on the other node, retried until the nodes are connected to each other
+	var pong string
+	for deadline := time.Now().Add(time.Second * 2); pong != "pong" && time.Now().Before(deadline); {
+		ctx, cancel := context.WithTimeout(bg, time.Millisecond*100)
+		res := make(chan string, 1)
+		_, err := sh1.Server.SendRequestContext(ctx, connID, "ping", nil, func(ctx *neptulon.ResCtx) error {
+			var s string
+			ctx.Result(&s)
+			res <- s
+			return nil
+		})
+		if err == nil {
+			pong = <-res
+		} else {
+			time.Sleep(time.Millisecond * 50)
+		}
+		cancel()
+	}
+	if pong != "pong" {
+		t.Fatalf("expected forwarded response: pong, got: %v", pong)
+	}
+
+	if err := sh1.Server.SendNotification(connID, "note", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	expect("2:note")
+
+	if err := sh1.Server.Broadcast("news", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expect("1:news", "2:news")
+
+	if err := ch2.Conn.Subscribe(bg, "chat.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh1.Server.Publish("chat.room1", "hey"); err != nil {
+		t.Fatal(err)
+	}
+	expect("2:" + neptulon.PublishMethod)
+
+	// request to a connection that does not exist on any node, without a timeout
+	res := make(chan string, 1)
+	_, err := sh1.Server.SendRequest("nonexistent", "ping", nil, func(ctx *neptulon.ResCtx) error {
+		res <- ctx.ErrorMessage
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeDisconnected {
+			t.Errorf("expected not found error response, got: %v, %v", ctx.ErrorCode, ctx.ErrorMessage)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-res:
+	case <-time.After(time.Second):
+		t.Fatal("request to nonexistent connection did not fail")
+	}
+}
+
+func TestBackplaneSingleNode(t *testing.T) {
+	sh := NewServerHelper(t)
+	if err := sh.Server.SetBackplane(neptulon.NewMemoryHub().Backplane()); err != nil {
+		t.Fatal(err)
+	}
+	defer sh.ListenAndServe().CloseWait()
+
+	if _, err := sh.Server.SendRequest("nonexistent", "ping", nil, func(ctx *neptulon.ResCtx) error {
+		t.Error("expected no response handler call")
+		return nil
+	}); err == nil {
+		t.Fatal("expected request to nonexistent connection to fail without other nodes")
+	}
+}
@@ -0,0 +1,209 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+)
+
+var codecs = []neptulon.Codec{neptulon.JSONCodec, neptulon.MsgPackCodec, neptulon.CBORCodec}
+
+type codecMsg struct {
+	N    int64                  `json:"n"`
+	U    uint64                 `json:"u"`
+	F    float64                `json:"f"`
+	B    bool                   `json:"b"`
+	Z    *string                `json:"z"`
+	S    string                 `json:"s"`
+	Bin  []byte                 `json:"bin"`
+	A    []interface{}          `json:"a"`
+	M    map[string]int         `json:"m,omitempty"`
+	O    map[string]interface{} `json:"o"`
+	Skip string                 `json:"-"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	msg := codecMsg{
+		N:   -1234567,
+		U:   18446744073709551615,
+		F:   1.5,
+		B:   true,
+		S:   "much text",
+		Bin: []byte{0, 1, 2, 0xff},
+		A:   []interface{}{1.0, "two", []interface{}{}, map[string]interface{}{}},
+		O:   map[string]interface{}{"wow": "such"},
+	}
+	for _, c := range codecs {
+		enc, err := c.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%v: %v", c.Name(), err)
+		}
+		var dec codecMsg
+		if err := c.Unmarshal(enc, &dec); err != nil {
+			t.Fatalf("%v: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(msg, dec) {
+			t.Fatalf("%v: expected: %+v got: %+v", c.Name(), msg, dec)
+		}
+	}
+}
+
+func TestCodecWireFormat(t *testing.T) {
+	cases := []struct {
+		codec neptulon.Codec
+		wire  []byte
+	}{
+		{neptulon.MsgPackCodec, []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x92, 0xd0, 0x80, 0xc0, 0xa1, 'c', 0xc4, 0x02, 0x01, 0x02}},
+		{neptulon.CBORCodec, []byte{0xa3, 0x61, 'a', 0x01, 0x61, 'b', 0x82, 0x38, 0x7f, 0xf6, 0x61, 'c', 0x42, 0x01, 0x02}},
+	}
+	msg := struct {
+		A int           `json:"a"`
+		B []interface{} `json:"b"`
+		C []byte        `json:"c"`
+	}{1, []interface{}{-128, nil}, []byte{1, 2}}
+
+	for _, c := range cases {
+		enc, err := c.codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%v: %v", c.codec.Name(), err)
+		}
+		if !bytes.Equal(enc, c.wire) {
+			t.Fatalf("%v: expected: %x got: %x", c.codec.Name(), c.wire, enc)
+		}
+
+		// binary values should be kept as is, even when decoded into an empty interface
+		var v map[string]interface{}
+		if err := c.codec.Unmarshal(enc, &v); err != nil {
+			t.Fatalf("%v: %v", c.codec.Name(), err)
+		}
+		if b, ok := v["c"].([]byte); !ok || !bytes.Equal(b, msg.C) {
+			t.Fatalf("%v: expected binary value %x, got: %#v", c.codec.Name(), msg.C, v["c"])
+		}
+
+		if err := c.codec.Unmarshal(enc[:len(enc)-1], &v); err == nil {
+			t.Fatalf("%v: expected truncated message to fail decoding", c.codec.Name())
+		}
+	}
+}
+
+func TestCodecDepthLimit(t *testing.T) {
+	cases := []struct {
+		codec      neptulon.Codec
+		array, nul byte // single element array header and null
+	}{
+		{neptulon.MsgPackCodec, 0x91, 0xc0},
+		{neptulon.CBORCodec, 0x81, 0xf6},
+	}
+
+	for _, c := range cases {
+		// deeply nested messages should fail decoding instead of overflowing the stack
+		var v interface{}
+		deep := append(bytes.Repeat([]byte{c.array}, 1<<20), c.nul)
+		if err := c.codec.Unmarshal(deep, &v); err == nil {
+			t.Fatalf("%v: expected deeply nested message to fail decoding", c.codec.Name())
+		}
+
+		nested := append(bytes.Repeat([]byte{c.array}, 100), c.nul)
+		if err := c.codec.Unmarshal(nested, &v); err != nil {
+			t.Fatalf("%v: %v", c.codec.Name(), err)
+		}
+		dec, _ := json.Marshal(v)
+		if want := strings.Repeat("[", 100) + "null" + strings.Repeat("]", 100); string(dec) != want {
+			t.Fatalf("%v: expected: %v got: %s", c.codec.Name(), want, dec)
+		}
+	}
+}
+
+func TestCodecConn(t *testing.T) {
+	for _, c := range codecs {
+		sh := NewServerHelper(t)
+		sh.Server.SetCodec(c)
+		sh.Server.MiddlewareFunc(middleware.Echo)
+		sh.ListenAndServe()
+
+		ch := sh.GetConnHelper()
+		ch.Conn.SetCodec(c)
+		ch.Connect()
+
+		var msg echoMsg
+		if err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: msg1}, &msg); err != nil {
+			t.Fatalf("%v: %v", c.Name(), err)
+		}
+		if msg.Message != msg1 {
+			t.Fatalf("%v: expected: %v got: %v", c.Name(), msg1, msg.Message)
+		}
+
+		var bin []byte
+		if err := ch.Conn.Call(context.Background(), "echo", []byte{0, 1, 0xff}, &bin); err != nil {
+			t.Fatalf("%v: %v", c.Name(), err)
+		}
+		if !bytes.Equal(bin, []byte{0, 1, 0xff}) {
+			t.Fatalf("%v: expected binary data to be echoed, got: %x", c.Name(), bin)
+		}
+
+		ch.CloseWait()
+		sh.CloseWait()
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	sh := NewServerHelper(t)
+	if err := sh.Server.SetCodecs(); err == nil {
+		t.Fatal("expected empty codec list to be rejected")
+	}
+	if err := sh.Server.SetCodecs(neptulon.MsgPackCodec, neptulon.JSONCodec, neptulon.CBORCodec); err != nil {
+		t.Fatal(err)
+	}
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		ctx.Res = ctx.Conn.Codec().Name()
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	cases := []struct {
+		codecs []neptulon.Codec
+		want   string
+	}{
+		{[]neptulon.Codec{neptulon.JSONCodec}, "json"},
+		{[]neptulon.Codec{neptulon.CBORCodec, neptulon.MsgPackCodec}, "cbor"},
+		{[]neptulon.Codec{neptulon.MsgPackCodec}, "msgpack"},
+	}
+
+	for _, c := range cases {
+		ch := sh.GetConnHelper()
+		if err := ch.Conn.SetCodecs(); err == nil {
+			t.Fatal("expected empty codec list to be rejected")
+		}
+		if err := ch.Conn.SetCodecs(c.codecs...); err != nil {
+			t.Fatal(err)
+		}
+		ch.Connect()
+
+		var name string
+		if err := ch.Conn.Call(context.Background(), "codec", nil, &name); err != nil {
+			t.Fatal(err)
+		}
+		if name != c.want || ch.Conn.Codec().Name() != c.want {
+			t.Fatalf("expected both peers to use %v codec, got: server: %v, client: %v", c.want, name, ch.Conn.Codec().Name())
+		}
+		ch.CloseWait()
+	}
+}
+
+func TestCodecNegotiationUnsupported(t *testing.T) {
+	sh := NewServerHelper(t)
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	ch.Conn.SetCodec(neptulon.CBORCodec)
+	if err := ch.Conn.Connect("ws://" + sh.Address); err == nil {
+		ch.CloseWait()
+		t.Fatal("expected connection requesting an unsupported codec to be rejected")
+	}
+}
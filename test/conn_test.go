@@ -0,0 +1,1207 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+)
+
+func TestResponseTimeout(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		// never respond to the request
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	gotRes := make(chan *neptulon.ResCtx, 1)
+	if _, err := ch.Conn.SendRequestTimeout("noreply", nil, time.Millisecond*20, func(ctx *neptulon.ResCtx) error {
+		gotRes <- ctx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ctx := <-gotRes:
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeTimeout {
+			t.Fatalf("expected timeout error response, got: %v, %v", ctx.ErrorCode, ctx.ErrorMessage)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response handler was not called after the timeout")
+	}
+}
+
+func TestPendingRequestsFailOnDisconnect(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		ctx.Conn.Close()
+		return nil
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	gotRes := make(chan *neptulon.ResCtx, 1)
+	if _, err := ch.Conn.SendRequest("close", nil, func(ctx *neptulon.ResCtx) error {
+		gotRes <- ctx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ctx := <-gotRes:
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeDisconnected {
+			t.Fatalf("expected disconnected error response, got: %v, %v", ctx.ErrorCode, ctx.ErrorMessage)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response handler was not called after disconnection")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetMaxMessageSize(1024)
+	sh.Server.MiddlewareFunc(middleware.Echo)
+	reasons := make(chan neptulon.DisconnReason, 1)
+	sh.Server.DisconnHandler(func(c *neptulon.Conn) { reasons <- c.DisconnReason() })
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	var msg echoMsg
+	if err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: "small"}, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var cerr *neptulon.CallError
+	err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: strings.Repeat("a", 2048)}, &msg)
+	if !errors.As(err, &cerr) || cerr.Code != neptulon.ErrCodeDisconnected {
+		t.Fatalf("expected connection to be closed upon a large message, got: %v", err)
+	}
+	select {
+	case reason := <-reasons:
+		if reason != neptulon.DisconnProtocolError {
+			t.Fatalf("expected protocol error disconnection reason, got: %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close the connection")
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetRequestTimeout(time.Millisecond * 20)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		select {
+		case <-ctx.Context().Done():
+			ctx.Res = ctx.Context().Err().Error()
+		case <-time.After(time.Second):
+			ctx.Res = "request context was not canceled in time"
+		}
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	ch.SendRequestSync("wait", nil, func(ctx *neptulon.ResCtx) error {
+		var res string
+		if err := ctx.Result(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res != context.DeadlineExceeded.Error() {
+			t.Fatalf("expected request context deadline to pass, got: %v", res)
+		}
+		return nil
+	})
+}
+
+func TestSendRequestContext(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		// never respond to the request
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "wow"))
+	gotRes := make(chan *neptulon.ResCtx, 1)
+	if _, err := ch.Conn.SendRequestContext(ctx, "noreply", nil, func(ctx *neptulon.ResCtx) error {
+		gotRes <- ctx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case ctx := <-gotRes:
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeCanceled {
+			t.Fatalf("expected canceled error response, got: %v, %v", ctx.ErrorCode, ctx.ErrorMessage)
+		}
+		if ctx.Context().Value(key{}) != "wow" {
+			t.Fatal("expected response context to carry the request context")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response handler was not called after context cancellation")
+	}
+}
+
+func TestCall(t *testing.T) {
+	sh := NewServerHelper(t)
+	route := middleware.NewRouter()
+	sh.Server.Middleware(route)
+	route.Request("echo", middleware.Echo)
+	route.Request("error", func(ctx *neptulon.ReqCtx) error {
+		ctx.Err = &neptulon.ResError{Code: 1234, Message: "much error", Data: "wow"}
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	var msg echoMsg
+	if err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: msg1}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Message != msg1 {
+		t.Fatalf("expected: %v got: %v", msg1, msg.Message)
+	}
+
+	err := ch.Conn.Call(context.Background(), "error", nil, nil)
+	cerr, ok := err.(*neptulon.CallError)
+	if !ok {
+		t.Fatalf("expected call error, got: %v", err)
+	}
+	if cerr.Code != 1234 || cerr.Message != "much error" || string(cerr.Data) != `"wow"` {
+		t.Fatalf("malformed call error: %v, %s", cerr, cerr.Data)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	sh := NewServerHelper(t)
+	started := make(chan bool)
+	canceled := make(chan bool, 1)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		started <- true
+		select {
+		case <-ctx.Context().Done():
+			canceled <- true
+		case <-time.After(time.Second):
+		}
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := ch.Conn.SendRequestContext(ctx, "longrunning", nil, func(ctx *neptulon.ResCtx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("request context was not canceled on the server after client canceled the request")
+	}
+}
+
+func TestConcurrencyLimitReject(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetConnConcurrency(1, neptulon.SaturationReject)
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "block" {
+			<-release
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- ch.Conn.Call(context.Background(), "block", nil, nil) }()
+	time.Sleep(time.Millisecond * 20)
+
+	err := ch.Conn.Call(context.Background(), "wow", nil, nil)
+	if cerr, ok := err.(*neptulon.CallError); !ok || cerr.Code != neptulon.ErrCodeServerBusy {
+		t.Fatalf("expected server busy error, got: %v", err)
+	}
+
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Conn.Call(context.Background(), "wow", nil, nil); err != nil {
+		t.Fatalf("expected request to succeed after the limit is freed, got: %v", err)
+	}
+}
+
+func TestConcurrencyLimitBlock(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetConnConcurrency(1, neptulon.SaturationBlock)
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "block" {
+			<-release
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- ch.Conn.Call(context.Background(), "block", nil, nil) }()
+	time.Sleep(time.Millisecond * 20)
+
+	// further requests should wait for the limit to be freed, instead of being rejected
+	waiting := make(chan error, 1)
+	go func() { waiting <- ch.Conn.Call(context.Background(), "wow", nil, nil) }()
+	select {
+	case err := <-waiting:
+		t.Fatalf("expected request to wait until the limit is freed, got: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	for _, res := range []chan error{blocked, waiting} {
+		select {
+		case err := <-res:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("expected requests to be handled once the limit is freed")
+		}
+	}
+}
+
+func TestConcurrencyLimitClose(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetConnConcurrency(1, neptulon.SaturationClose)
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "block" {
+			<-release
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	reasons := make(chan neptulon.DisconnReason, 1)
+	sh.Server.DisconnHandler(func(c *neptulon.Conn) { reasons <- c.DisconnReason() })
+	defer sh.ListenAndServe().CloseWait()
+	defer close(release)
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- ch.Conn.Call(context.Background(), "block", nil, nil) }()
+	time.Sleep(time.Millisecond * 20)
+
+	// exceeding the limit should close the connection, failing the pending requests
+	if err := ch.Conn.Call(context.Background(), "wow", nil, nil); err == nil {
+		t.Fatal("expected request to fail once the connection is closed")
+	}
+	select {
+	case err := <-blocked:
+		if cerr, ok := err.(*neptulon.CallError); !ok || cerr.Code != neptulon.ErrCodeDisconnected {
+			t.Fatalf("expected pending request to fail with code %v, got: %v", neptulon.ErrCodeDisconnected, err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected pending request to fail once the connection is closed")
+	}
+	select {
+	case reason := <-reasons:
+		if reason != neptulon.DisconnLimitReached {
+			t.Fatalf("expected disconnection reason %v, got: %v", neptulon.DisconnLimitReached, reason)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected connection to be closed once the limit is reached")
+	}
+}
+
+func TestServerConcurrencyLimit(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetConcurrency(1, neptulon.SaturationReject)
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "block" {
+			<-release
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch1 := sh.GetConnHelper().Connect()
+	defer ch1.CloseWait()
+	ch2 := sh.GetConnHelper().Connect()
+	defer ch2.CloseWait()
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- ch1.Conn.Call(context.Background(), "block", nil, nil) }()
+	time.Sleep(time.Millisecond * 20)
+
+	// limit is shared by all client connections
+	err := ch2.Conn.Call(context.Background(), "wow", nil, nil)
+	if cerr, ok := err.(*neptulon.CallError); !ok || cerr.Code != neptulon.ErrCodeServerBusy {
+		t.Fatalf("expected server busy error, got: %v", err)
+	}
+
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	if err := ch2.Conn.Call(context.Background(), "wow", nil, nil); err != nil {
+		t.Fatalf("expected request to succeed after the limit is freed, got: %v", err)
+	}
+}
+
+func TestSendQueueBackpressure(t *testing.T) {
+	const n = 20
+	sh := NewServerHelper(t)
+	if err := sh.Server.SetSendQueueSize(0); err == nil {
+		t.Fatal("expected zero send queue size to be rejected")
+	}
+	if err := sh.Server.SetSendQueueSize(1); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		<-release
+		ctx.Res = strings.Repeat("a", 1<<18) // large responses take a while to be written, which fills the queue
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	if err := ch.Conn.SetSendQueueSize(-1); err == nil {
+		t.Fatal("expected negative send queue size to be rejected")
+	}
+	ch.Connect()
+	defer ch.CloseWait()
+
+	res := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { res <- ch.Conn.Call(context.Background(), "wow", nil, nil) }()
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	// all the responses are sent at once, which should wait for room in the queue instead of closing the connection
+	close(release)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-res:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("expected all the responses to be received")
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	const n = 20
+	sh := NewServerHelper(t)
+	sh.Server.SetOrdered(true)
+	var mutex sync.Mutex
+	var order []int
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var i int
+		if err := ctx.Params(&i); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(3))) // shuffle completion order if not ordered
+		mutex.Lock()
+		order = append(order, i)
+		mutex.Unlock()
+		ctx.Res = i
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	res := make(chan int, n)
+	for i := 0; i < n; i++ {
+		if _, err := ch.Conn.SendRequest("seq", i, func(ctx *neptulon.ResCtx) error {
+			var i int
+			err := ctx.Result(&i)
+			res <- i
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-res:
+		case <-time.After(time.Second * 3):
+			t.Fatal("did not get all the responses in time")
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, o := range order {
+		if i != o {
+			t.Fatalf("expected requests to be handled in arrival order, got: %v", order)
+		}
+	}
+}
+
+func TestOrderKey(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetOrderKey(func(ctx *neptulon.ReqCtx) string {
+		if ctx.Method == "free" {
+			return ""
+		}
+		return neptulon.OrderByMethod(ctx)
+	})
+	started := make(chan string, 10)
+	release := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var block bool
+		if err := ctx.Params(&block); err != nil {
+			return err
+		}
+		started <- ctx.Method
+		if block {
+			<-release
+		}
+		ctx.Res = ctx.Method
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	res := make(chan error, 5)
+	send := func(method string, block bool) {
+		go func() { res <- ch.Conn.Call(context.Background(), method, block, nil) }()
+	}
+	expectStarted := func(want ...string) {
+		var got []string
+		for range want {
+			select {
+			case m := <-started:
+				got = append(got, m)
+			case <-time.After(time.Second):
+				t.Fatalf("expected requests to be handled: %v, got: %v", want, got)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected requests to be handled: %v, got: %v", want, got)
+		}
+	}
+
+	send("a", true)
+	expectStarted("a")
+
+	// requests with the same key wait for the previous ones, while the ones with different or empty keys are handled concurrently
+	send("a", false)
+	send("b", true)
+	send("free", true)
+	send("free", true)
+	expectStarted("b", "free", "free")
+	select {
+	case m := <-started:
+		t.Fatalf("expected request to wait for the previous one with the same key, got: %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	expectStarted("a")
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-res:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("did not get all the responses in time")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "drop" {
+			ctx.Conn.Close()
+			return nil
+		}
+		ctx.Res = "pong"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	if err := ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Factor: 0.5}); err == nil {
+		t.Fatal("expected backoff factor less than 1 to be rejected")
+	}
+	if err := ch.Conn.SetReconnect(&neptulon.Backoff{Factor: 2}); err == nil {
+		t.Fatal("expected zero backoff min delay to be rejected")
+	}
+	if err := ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Factor: 2, Jitter: 1.5}); err == nil {
+		t.Fatal("expected backoff jitter greater than 1 to be rejected")
+	}
+	if err := ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Factor: 2, Jitter: -0.1}); err == nil {
+		t.Fatal("expected negative backoff jitter to be rejected")
+	}
+	if err := ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2}); err != nil {
+		t.Fatal(err)
+	}
+	reconnected := make(chan bool, 1)
+	ch.Conn.ReconnHandler(func(c *neptulon.Conn) error {
+		// handler should be able to make calls over the new connection
+		reconnected <- c.Call(context.Background(), "ping", nil, nil) == nil
+		return nil
+	})
+	states := make(chan neptulon.ConnState, 10)
+	ch.Conn.StateHandler(func(c *neptulon.Conn, state neptulon.ConnState) { states <- state })
+	ch.Connect()
+	defer ch.CloseWait()
+	ch.Conn.Session.Set("user", "wow")
+
+	if err := ch.Conn.SendNotification("drop", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ok := <-reconnected:
+		if !ok {
+			t.Fatal("reconnect handler failed to call the server")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("client did not reconnect in time")
+	}
+
+	for _, want := range []neptulon.ConnState{neptulon.StateConnected, neptulon.StateReconnecting, neptulon.StateConnected} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("expected state %v, got: %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected state %v", want)
+		}
+	}
+
+	if err := ch.Conn.Call(context.Background(), "ping", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ch.Conn.Session.Get("user") != "wow" {
+		t.Fatal("expected session data to be kept across reconnections")
+	}
+}
+
+func TestPingKeepAlive(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetPingInterval(time.Millisecond * 20)
+	sh.Server.SetIdleTimeout(time.Millisecond * 100)
+	sh.Server.MiddlewareFunc(middleware.Echo)
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	ch.Conn.SetPingInterval(0)
+	ch.Connect()
+	defer ch.CloseWait()
+
+	// pongs from the client should keep the connection alive
+	time.Sleep(time.Millisecond * 300)
+	var msg echoMsg
+	if err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: msg1}, &msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetPingInterval(0)
+	sh.Server.SetIdleTimeout(time.Millisecond * 50)
+	disconnErr := make(chan error, 1)
+	sh.Server.DisconnHandler(func(c *neptulon.Conn) {
+		if c.DisconnReason() != neptulon.DisconnDeadlineExceeded {
+			t.Errorf("expected deadline exceeded disconnection reason, got: %v", c.DisconnReason())
+		}
+		disconnErr <- c.Err()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	ch.Conn.SetPingInterval(0)
+	ch.Connect()
+	defer ch.CloseWait()
+
+	select {
+	case err := <-disconnErr:
+		if err != neptulon.ErrIdleTimeout {
+			t.Fatalf("expected idle timeout disconnection reason, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not close the idle connection in time")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	sh := NewServerHelper(t)
+	events := make(chan *neptulon.Event, 10)
+	sh.Server.EventHandler(func(e *neptulon.Event) { events <- e })
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		switch ctx.Method {
+		case "auth":
+			ctx.Conn.MarkAuthenticated("wow")
+		case "fail":
+			return errors.New("much error")
+		}
+		ctx.Res = "ok"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	expect := func(typ neptulon.EventType, reason neptulon.DisconnReason) {
+		select {
+		case e := <-events:
+			if e.Type != typ || (typ == neptulon.EventDisconnected && e.Reason != reason) {
+				t.Fatalf("expected %v event with reason %v, got: %v event with reason %v", typ, reason, e.Type, e.Reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %v event", typ)
+		}
+	}
+
+	ch := sh.GetConnHelper().Connect()
+	expect(neptulon.EventConnected, 0)
+	if err := ch.Conn.Call(context.Background(), "auth", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(neptulon.EventAuthenticated, 0)
+	ch.CloseWait()
+	expect(neptulon.EventDisconnected, neptulon.DisconnPeerClosed)
+
+	ch = sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+	expect(neptulon.EventConnected, 0)
+	if err := ch.Conn.SendNotification("fail", nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(neptulon.EventDisconnected, neptulon.DisconnMiddlewareError)
+}
+
+func TestServeHTTP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short testing mode.")
+	}
+
+	s := neptulon.NewServer("")
+	s.MiddlewareFunc(middleware.Echo)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", s)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+	defer s.Close()
+
+	res, err := http.Get(hs.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected other routes to keep working, got: %v", res.Status)
+	}
+
+	ch := NewConnHelper(t, "ws"+strings.TrimPrefix(hs.URL, "http")+"/ws").Connect()
+	defer ch.CloseWait()
+
+	var msg echoMsg
+	if err := ch.Conn.Call(context.Background(), "echo", echoMsg{Message: msg1}, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Message != msg1 {
+		t.Fatalf("expected: %v got: %v", msg1, msg.Message)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetShutdownNotice(true)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "slow" {
+			time.Sleep(time.Millisecond * 200)
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	notified := make(chan bool, 1)
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == neptulon.ShutdownMethod {
+			notified <- true
+		}
+		return ctx.Next()
+	})
+	ch.Connect()
+	defer ch.CloseWait()
+
+	slow := make(chan error, 1)
+	go func() { slow <- ch.Conn.Call(context.Background(), "slow", nil, nil) }()
+	time.Sleep(time.Millisecond * 20)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- sh.Server.Shutdown(context.Background()) }()
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("client was not notified of the shutdown")
+	}
+
+	err := ch.Conn.Call(context.Background(), "wow", nil, nil)
+	if cerr, ok := err.(*neptulon.CallError); !ok || cerr.Code != neptulon.ErrCodeShuttingDown {
+		t.Fatalf("expected shutting down error, got: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Fatalf("expected in-flight request to complete, got: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		<-ctx.Context().Done()
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	if _, err := ch.Conn.SendRequest("block", nil, func(ctx *neptulon.ResCtx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := sh.Server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected shutdown to time out, got: %v", err)
+	}
+}
+
+func TestServerWaitTimeout(t *testing.T) {
+	sh := NewServerHelper(t)
+	release := make(chan struct{})
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		<-release
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	if _, err := ch.Conn.SendRequest("block", nil, func(ctx *neptulon.ResCtx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if err := sh.Server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := sh.Server.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected wait to time out while a request is being handled, got: %v", err)
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sh.Server.Wait(ctx); err != nil {
+		t.Fatalf("expected wait to return once the request is handled, got: %v", err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var name string
+		if err := ctx.Params(&name); err != nil {
+			return err
+		}
+		ctx.Conn.Session.Set("name", name)
+		ctx.Res = "ok"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	names := []string{"alice", "bob", "bob"}
+	got := make(chan string, 10)
+	for _, name := range names {
+		name := name
+		ch := sh.GetConnHelper()
+		ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+			got <- name
+			ctx.Res = name
+			return ctx.Next()
+		})
+		ch.Connect()
+		defer ch.CloseWait()
+		if err := ch.Conn.Call(context.Background(), "login", name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collect := func(n int) map[string]int {
+		m := make(map[string]int)
+		for i := 0; i < n; i++ {
+			select {
+			case name := <-got:
+				m[name]++
+			case <-time.After(time.Second):
+				t.Fatalf("expected %v messages, got %v", n, i)
+			}
+		}
+		return m
+	}
+
+	if err := sh.Server.Broadcast("news", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if m := collect(3); m["alice"] != 1 || m["bob"] != 2 {
+		t.Fatalf("expected broadcast to reach all connections, got: %v", m)
+	}
+
+	isBob := func(c *neptulon.Conn) bool { return c.Session.Get("name") == "bob" }
+	if err := sh.Server.Multicast(isBob, "news", "hello bob"); err != nil {
+		t.Fatal(err)
+	}
+	if m := collect(2); m["bob"] != 2 {
+		t.Fatalf("expected multicast to reach only the matching connections, got: %v", m)
+	}
+
+	res, err := sh.Server.BroadcastRequest(context.Background(), "whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(3)
+	if len(res.Responses) != 3 || len(res.Errors) != 0 {
+		t.Fatalf("expected 3 responses, got: %v, errors: %v", len(res.Responses), res.Errors)
+	}
+	for connID, rctx := range res.Responses {
+		var name string
+		if err := rctx.Result(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != rctx.Conn.Session.Get("name") {
+			t.Fatalf("expected response from %v to match its session, got: %v", connID, name)
+		}
+	}
+}
+
+func TestRooms(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var room string
+		if err := ctx.Params(&room); err != nil {
+			return err
+		}
+		switch ctx.Method {
+		case "join":
+			if err := sh.Server.Join(ctx.Conn.ID, room); err != nil {
+				return err
+			}
+		case "leave":
+			if err := sh.Server.Leave(ctx.Conn.ID, room); err != nil {
+				ctx.Err = &neptulon.ResError{Code: 1234, Message: err.Error()}
+			}
+		}
+		ctx.Res = ctx.Conn.ID
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	got := make(chan int, 10)
+	var chs []*ConnHelper
+	for i := 0; i < 3; i++ {
+		i := i
+		ch := sh.GetConnHelper()
+		ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+			got <- i
+			ctx.Res = i
+			return ctx.Next()
+		})
+		chs = append(chs, ch.Connect())
+	}
+	defer chs[2].CloseWait()
+	defer chs[1].CloseWait()
+
+	// connection IDs differ on client and server sides
+	ids := make([]string, 3)
+	call := func(i int, method, room string) {
+		if err := chs[i].Conn.Call(context.Background(), method, room, &ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call(0, "join", "lobby")
+	call(1, "join", "lobby")
+	call(1, "join", "games")
+	call(2, "join", "games")
+
+	if rooms := sh.Server.Rooms(); !reflect.DeepEqual(rooms, []string{"games", "lobby"}) {
+		t.Fatalf("expected rooms to be listed, got: %v", rooms)
+	}
+	if rooms := sh.Server.ConnRooms(ids[1]); len(rooms) != 2 {
+		t.Fatalf("expected connection to be in 2 rooms, got: %v", rooms)
+	}
+	if members := sh.Server.RoomMembers("lobby"); len(members) != 2 {
+		t.Fatalf("expected 2 members in room, got: %v", members)
+	}
+
+	if err := sh.Server.SendRoomNotification("games", "msg", "gg"); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := <-got, <-got; a+b != 3 || a == b {
+		t.Fatalf("expected room notification to reach connections 1 and 2, got: %v, %v", a, b)
+	}
+
+	call(1, "leave", "games")
+	if members := sh.Server.RoomMembers("games"); len(members) != 1 {
+		t.Fatalf("expected 1 member in room, got: %v", members)
+	}
+	if err := chs[1].Conn.Call(context.Background(), "leave", "games", nil); err == nil {
+		t.Fatal("expected error leaving a room that the connection is not in")
+	}
+
+	// disconnected connections should leave their rooms
+	chs[0].CloseWait()
+	deadline := time.Now().Add(time.Second)
+	for len(sh.Server.RoomMembers("lobby")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected disconnected connection to leave the room, got: %v", sh.Server.RoomMembers("lobby"))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	res, err := sh.Server.SendRoomRequest(context.Background(), "lobby", "ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Responses[ids[1]]; !ok || len(res.Responses) != 1 {
+		t.Fatalf("expected a single response from the room member, got: %v", res.Responses)
+	}
+	if i := <-got; i != 1 {
+		t.Fatalf("expected room request to reach connection 1, got: %v", i)
+	}
+}
+
+func TestUserConns(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var userID string
+		if err := ctx.Params(&userID); err != nil {
+			return err
+		}
+		ctx.Conn.MarkAuthenticated(userID)
+		ctx.Res = ctx.Conn.ID
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	users := []string{"alice", "alice", "bob"}
+	ids := make([]string, len(users))
+	got := make(chan int, 10)
+	var chs []*ConnHelper
+	for i, userID := range users {
+		i := i
+		ch := sh.GetConnHelper()
+		ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+			got <- i
+			ctx.Res = i
+			return ctx.Next()
+		})
+		chs = append(chs, ch.Connect())
+		if err := ch.Conn.Call(context.Background(), "login", userID, &ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer chs[2].CloseWait()
+	defer chs[1].CloseWait()
+
+	if u := sh.Server.Users(); !reflect.DeepEqual(u, []string{"alice", "bob"}) {
+		t.Fatalf("expected users to be listed, got: %v", u)
+	}
+	if conns := sh.Server.UserConns("alice"); len(conns) != 2 {
+		t.Fatalf("expected 2 connections for user, got: %v", conns)
+	}
+
+	results, err := sh.Server.SendToUser("alice", "msg", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[ids[0]] != nil || results[ids[1]] != nil {
+		t.Fatalf("expected notification to be sent to both devices, got: %v", results)
+	}
+	if a, b := <-got, <-got; a+b != 1 || a == b {
+		t.Fatalf("expected notification to reach connections 0 and 1, got: %v, %v", a, b)
+	}
+
+	res, err := sh.Server.SendRequestToUser(context.Background(), "bob", "ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rctx, ok := res.Responses[ids[2]]; !ok || len(res.Responses) != 1 || !rctx.Success {
+		t.Fatalf("expected a single response from the user's device, got: %v", res.Responses)
+	}
+	<-got
+
+	if _, err := sh.Server.SendToUser("carol", "msg", "hi"); err != neptulon.ErrUserNotConnected {
+		t.Fatalf("expected user not connected error, got: %v", err)
+	}
+
+	// disconnected connections should be removed from the user's connections
+	chs[0].CloseWait()
+	deadline := time.Now().Add(time.Second)
+	for len(sh.Server.UserConns("alice")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected disconnected connection to be removed, got: %v", sh.Server.UserConns("alice"))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	sh := NewServerHelper(t)
+	defer sh.ListenAndServe().CloseWait()
+
+	got := make(chan string, 10)
+	var chs []*ConnHelper
+	for i := 0; i < 2; i++ {
+		i := i
+		ch := sh.GetConnHelper()
+		ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+			var p neptulon.Publication
+			if err := ctx.Params(&p); err != nil {
+				return err
+			}
+			var data string
+			if err := json.Unmarshal(p.Data, &data); err != nil {
+				return err
+			}
+			got <- fmt.Sprintf("%v:%v:%v", i, p.Topic, data)
+			return ctx.Next()
+		})
+		chs = append(chs, ch.Connect())
+	}
+	defer chs[1].CloseWait()
+
+	bg := context.Background()
+	for _, sub := range []struct {
+		i     int
+		topic string
+	}{{0, "chat.*"}, {1, "chat.>"}, {1, "chat.room1"}} {
+		if err := chs[sub.i].Conn.Subscribe(bg, sub.topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chs[0].Conn.Subscribe(bg, "chat.>.x"); err == nil || err.(*neptulon.CallError).Code != neptulon.ErrCodeInvalidParams {
+		t.Fatalf("expected invalid params error for invalid topic pattern, got: %v", err)
+	}
+	if topics := sh.Server.Topics(); !reflect.DeepEqual(topics, []string{"chat.*", "chat.>", "chat.room1"}) {
+		t.Fatalf("expected topics to be listed, got: %v", topics)
+	}
+
+	expect := func(msgs ...string) {
+		var recv []string
+		for range msgs {
+			select {
+			case m := <-got:
+				recv = append(recv, m)
+			case <-time.After(time.Second):
+				t.Fatalf("expected messages: %v, got: %v", msgs, recv)
+			}
+		}
+		sort.Strings(recv)
+		if !reflect.DeepEqual(recv, msgs) {
+			t.Fatalf("expected messages: %v, got: %v", msgs, recv)
+		}
+	}
+
+	// connections subscribed to multiple matching patterns should receive the data once
+	if err := sh.Server.Publish("chat.room1", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	expect("0:chat.room1:hi", "1:chat.room1:hi")
+
+	if err := sh.Server.Publish("chat.room1.typing", "wow"); err != nil {
+		t.Fatal(err)
+	}
+	expect("1:chat.room1.typing:wow")
+
+	if err := chs[1].Conn.Unsubscribe(bg, "chat.>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Server.Publish("chat.room2", "hey"); err != nil {
+		t.Fatal(err)
+	}
+	expect("0:chat.room2:hey")
+
+	// disconnected connections should be unsubscribed
+	chs[0].CloseWait()
+	deadline := time.Now().Add(time.Second)
+	for len(sh.Server.Subscribers("chat.*")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected disconnected connection to be unsubscribed, got: %v", sh.Server.Subscribers("chat.*"))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
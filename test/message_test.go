@@ -1,6 +1,8 @@
 package test
 
 import (
+	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
@@ -86,7 +88,59 @@ func TestMessages(t *testing.T) {
 }
 
 func TestBidirectional(t *testing.T) {
-	// todo: test simultaneous read/writes
+	const n = 100
+	var wg sync.WaitGroup
+	verify := func(m string) func(ctx *neptulon.ResCtx) error {
+		return func(ctx *neptulon.ResCtx) error {
+			defer wg.Done()
+			var msg echoMsg
+			if err := ctx.Result(&msg); err != nil {
+				t.Error(err)
+			}
+			if msg.Message != m {
+				t.Errorf("expected: %v got: %v", m, msg.Message)
+			}
+			return nil
+		}
+	}
+
+	// server echoes each request and sends its own request back to the client concurrently
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method == "echo" {
+			wg.Add(1)
+			if _, err := ctx.Conn.SendRequest("echo", echoMsg{Message: msg2}, verify(msg2)); err != nil {
+				t.Error(err)
+			}
+		}
+		return middleware.Echo(ctx)
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	ch.Conn.MiddlewareFunc(middleware.Echo)
+	defer ch.Connect().CloseWait()
+
+	var sent sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sent.Add(1)
+		go func() {
+			defer sent.Done()
+			if _, err := ch.Conn.SendRequest("echo", echoMsg{Message: msg1}, verify(msg1)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	sent.Wait()
+
+	done := make(chan bool)
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("did not get all the responses in time")
+	}
 }
 
 func TestTLS(t *testing.T) {
@@ -136,3 +190,234 @@ func TestError(t *testing.T) {
 func TestPanic(t *testing.T) {
 	// todo: panic from inside a req handler and make sure that server/client does not crash and conn is closed
 }
+
+func TestStrictJSONRPC(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetStrict(true)
+	sh.Server.MiddlewareFunc(middleware.Echo)
+	defer sh.ListenAndServe().CloseWait()
+
+	ws, err := websocket.Dial("ws://"+sh.Address, "", "http://127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	cases := []struct {
+		req  string
+		id   string
+		code int
+	}{
+		{req: `{"jsonrpc":"2.0","id":42,"method":"echo","params":"wow"}`, id: "42"},
+		{req: `{"jsonrpc":"2.0","id":null,"method":"echo","params":"wow"}`, id: "null"},
+		{req: `{"jsonrpc":"2.0","id":"abc","method":"echo"`, id: "null", code: neptulon.ErrCodeParse},
+		{req: `{"id":"abc","method":"echo","params":"wow"}`, id: `"abc"`, code: neptulon.ErrCodeInvalidRequest},
+		{req: `{"jsonrpc":"2.0","id":{},"method":"echo","params":"wow"}`, id: "null", code: neptulon.ErrCodeInvalidRequest},
+		{req: `{"jsonrpc":"2.0","id":"abc","method":1}`, id: `"abc"`, code: neptulon.ErrCodeInvalidRequest},
+	}
+
+	for _, c := range cases {
+		if err := websocket.Message.Send(ws, c.req); err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			JSONRPC string          `json:"jsonrpc"`
+			ID      json.RawMessage `json:"id"`
+			Result  interface{}     `json:"result"`
+			Error   *struct {
+				Code int `json:"code"`
+			} `json:"error"`
+		}
+		if err := websocket.JSON.Receive(ws, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.JSONRPC != "2.0" {
+			t.Errorf("expected jsonrpc member to be 2.0 for request %v, got: %v", c.req, res.JSONRPC)
+		}
+		if string(res.ID) != c.id {
+			t.Errorf("expected id %v for request %v, got: %s", c.id, c.req, res.ID)
+		}
+		if c.code == 0 && (res.Error != nil || res.Result != "wow") {
+			t.Errorf("expected echo response for request %v, got: %v, %v", c.req, res.Result, res.Error)
+		}
+		if c.code != 0 && (res.Error == nil || res.Error.Code != c.code) {
+			t.Errorf("expected error code %v for request %v, got: %v", c.code, c.req, res.Error)
+		}
+	}
+}
+
+func TestNotification(t *testing.T) {
+	sh := NewServerHelper(t)
+	gotNot := make(chan string)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if !ctx.IsNotification() {
+			t.Errorf("expected request to be a notification: %v", ctx.Method)
+		}
+		var msg echoMsg
+		if err := ctx.Params(&msg); err != nil {
+			t.Error(err)
+		}
+		ctx.Res = msg // should never be sent back
+		gotNot <- msg.Message
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ws, err := websocket.Dial("ws://"+sh.Address, "", "http://127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := websocket.Message.Send(ws, `{"jsonrpc":"2.0","method":"notify","params":{"message":"wow"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-gotNot:
+		if m != "wow" {
+			t.Fatalf("expected: wow got: %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the notification in time")
+	}
+
+	// make sure that no response is returned for the notification
+	gotRes := make(chan bool)
+	go func() {
+		var res interface{}
+		if websocket.JSON.Receive(ws, &res) == nil {
+			gotRes <- true
+		}
+	}()
+
+	select {
+	case <-gotRes:
+		t.Fatal("expected no response for notification, got one")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestSendNotification(t *testing.T) {
+	sh := NewServerHelper(t)
+	var connID string
+	connected := make(chan bool)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		connID = ctx.Conn.ID
+		ctx.Res = "ok"
+		connected <- true
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	gotNot := make(chan string)
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var msg echoMsg
+		if err := ctx.Params(&msg); err != nil {
+			t.Error(err)
+		}
+		gotNot <- msg.Message
+		return ctx.Next()
+	})
+	defer ch.Connect().CloseWait()
+
+	if _, err := ch.Conn.SendRequest("hello", nil, func(ctx *neptulon.ResCtx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+
+	if err := sh.Server.SendNotification(connID, "notify", echoMsg{Message: "wow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-gotNot:
+		if m != "wow" {
+			t.Fatalf("expected: wow got: %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the notification in time")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(middleware.Echo)
+	defer sh.ListenAndServe().CloseWait()
+
+	ws, err := websocket.Dial("ws://"+sh.Address, "", "http://127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	batch := `[
+		{"jsonrpc":"2.0","id":"1","method":"echo","params":"one"},
+		{"jsonrpc":"2.0","method":"echo","params":"notification"},
+		{"jsonrpc":"2.0","id":2,"method":"echo","params":"two"}
+	]`
+	if err := websocket.Message.Send(ws, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var res []struct {
+		ID     json.RawMessage `json:"id"`
+		Result string          `json:"result"`
+	}
+	if err := websocket.JSON.Receive(ws, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 responses in batch response, got: %v", len(res))
+	}
+	if string(res[0].ID) != `"1"` || res[0].Result != "one" || string(res[1].ID) != "2" || res[1].Result != "two" {
+		t.Fatalf("malformed batch response: %v", res)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.MiddlewareFunc(middleware.Echo)
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	var wg sync.WaitGroup
+	handler := func(m string) func(ctx *neptulon.ResCtx) error {
+		return func(ctx *neptulon.ResCtx) error {
+			defer wg.Done()
+			var msg echoMsg
+			if err := ctx.Result(&msg); err != nil {
+				t.Error(err)
+			}
+			if msg.Message != m {
+				t.Errorf("expected: %v got: %v", m, msg.Message)
+			}
+			return nil
+		}
+	}
+
+	wg.Add(3)
+	ids, err := ch.Conn.SendBatch(
+		neptulon.BatchRequest{Method: "echo", Params: echoMsg{Message: msg1}, ResHandler: handler(msg1)},
+		neptulon.BatchRequest{Method: "echo", Params: echoMsg{Message: msg2}},
+		neptulon.BatchRequest{Method: "echo", Params: echoMsg{Message: msg3}, ResHandler: handler(msg3)},
+		neptulon.BatchRequest{Method: "echo", Params: echoMsg{Message: msg4}, ResHandler: handler(msg4)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 4 || ids[0] == "" || ids[1] != "" {
+		t.Fatalf("expected request IDs only for requests with response handlers, got: %v", ids)
+	}
+
+	done := make(chan bool)
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("did not get all batch responses in time")
+	}
+}
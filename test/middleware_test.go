@@ -23,7 +23,10 @@ func TestMiddlewarePanics(t *testing.T) {
 
 	gotRes := make(chan bool)
 	ch.Conn.SendRequest("echo", echoMsg{Message: "just testing"}, func(ctx *neptulon.ResCtx) error {
-		gotRes <- true
+		// pending requests are failed with a synthesized error when the connection is closed
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeDisconnected {
+			gotRes <- true
+		}
 		return nil
 	})
 
@@ -50,7 +53,10 @@ func TestMiddlewareRetursError(t *testing.T) {
 
 	gotRes := make(chan bool)
 	ch.Conn.SendRequest("echo", echoMsg{Message: "just testing"}, func(ctx *neptulon.ResCtx) error {
-		gotRes <- true
+		// pending requests are failed with a synthesized error when the connection is closed
+		if ctx.Success || ctx.ErrorCode != neptulon.ErrCodeDisconnected {
+			gotRes <- true
+		}
 		return nil
 	})
 
@@ -0,0 +1,493 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+)
+
+func TestSessionResume(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetResumeGracePeriod(time.Second)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		switch ctx.Method {
+		case "set":
+			ctx.Conn.Session.Set("user", "wow")
+			ctx.Res = ctx.Conn.ID
+		case "get":
+			ctx.Res = ctx.Conn.Session.Get("user")
+		}
+		return ctx.Next()
+	})
+	suspended := make(chan string, 2)
+	sh.Server.EventHandler(func(e *neptulon.Event) {
+		if e.Type == neptulon.EventDisconnected {
+			suspended <- e.Conn.ID
+		}
+	})
+	disconns := make(chan string, 2)
+	sh.Server.DisconnHandler(func(c *neptulon.Conn) { disconns <- c.ID })
+	defer sh.ListenAndServe().CloseWait()
+
+	proxy := newDropProxy(t, "127.0.0.1:3003", laddr)
+	defer proxy.close()
+
+	ch := NewConnHelper(t, "ws://127.0.0.1:3003")
+	ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2})
+	ch.Conn.SetOrdered(true)
+	reconnected := make(chan bool, 2)
+	ch.Conn.ReconnHandler(func(c *neptulon.Conn) error {
+		reconnected <- true
+		return nil
+	})
+	resumed := make(chan bool, 2)
+	ch.Conn.EventHandler(func(e *neptulon.Event) {
+		if e.Type == neptulon.EventResumed {
+			resumed <- true
+		}
+	})
+	hellos := make(chan int, 10)
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var n int
+		if err := ctx.Params(&n); err != nil {
+			return err
+		}
+		hellos <- n
+		ctx.Res = n
+		return ctx.Next()
+	})
+	ch.Connect()
+	defer ch.CloseWait()
+
+	var id string
+	if err := ch.Conn.Call(context.Background(), "set", nil, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests sent while the client is away should be kept, and sent in order once the session is resumed
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	res := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		_, err := sh.Server.SendRequest(id, "hello", i, func(ctx *neptulon.ResCtx) error {
+			var n int
+			if err := ctx.Result(&n); err != nil {
+				t.Error(err)
+			}
+			res <- n
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	proxy.up()
+
+	select {
+	case <-resumed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("client did not resume the session in time")
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case n := <-hellos:
+			if n != i {
+				t.Fatalf("expected request %v, got: %v", i, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected request %v to be sent upon resumption", i)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case <-res:
+		case <-time.After(time.Second):
+			t.Fatal("expected responses to be received upon resumption")
+		}
+	}
+
+	var resumedID, user string
+	if err := ch.Conn.Call(context.Background(), "set", nil, &resumedID); err != nil {
+		t.Fatal(err)
+	}
+	if resumedID != id {
+		t.Fatalf("expected resumed connection to keep its ID %v, got: %v", id, resumedID)
+	}
+	if err := ch.Conn.Call(context.Background(), "get", nil, &user); err != nil || user != "wow" {
+		t.Fatalf("expected session data to be kept upon resumption, got: %v, %v", user, err)
+	}
+
+	// session should be closed once the grace period expires, failing the pending requests
+	<-reconnected
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	codes := make(chan int, 1)
+	if _, err := sh.Server.SendRequest(id, "hello", 4, func(ctx *neptulon.ResCtx) error {
+		codes <- ctx.ErrorCode
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectString(t, disconns, id, "expected session to expire")
+	select {
+	case code := <-codes:
+		if code != neptulon.ErrCodeDisconnected {
+			t.Fatalf("expected pending request to fail with code %v, got: %v", neptulon.ErrCodeDisconnected, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pending request to fail once the session expired")
+	}
+	proxy.up()
+
+	// client should get a new session afterwards
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 3):
+		t.Fatal("client did not reconnect in time")
+	}
+	var newID string
+	if err := ch.Conn.Call(context.Background(), "set", nil, &newID); err != nil {
+		t.Fatal(err)
+	}
+	if newID == id {
+		t.Fatal("expected a new session after the grace period expired")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("expected expired session not to be resumed")
+	default:
+	}
+}
+
+func TestSessionResumeClientRequests(t *testing.T) {
+	sh := NewServerHelper(t)
+	sh.Server.SetResumeGracePeriod(time.Millisecond * 500)
+	started := make(chan bool, 2)
+	release := make(chan bool, 2)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		switch ctx.Method {
+		case "id":
+			ctx.Res = ctx.Conn.ID
+		case "slow":
+			started <- true
+			<-release
+			ctx.Res = "done"
+		}
+		return ctx.Next()
+	})
+	suspended := make(chan string, 2)
+	sh.Server.EventHandler(func(e *neptulon.Event) {
+		if e.Type == neptulon.EventDisconnected {
+			suspended <- e.Conn.ID
+		}
+	})
+	disconns := make(chan string, 2)
+	sh.Server.DisconnHandler(func(c *neptulon.Conn) { disconns <- c.ID })
+	defer sh.ListenAndServe().CloseWait()
+
+	proxy := newDropProxy(t, "127.0.0.1:3003", laddr)
+	defer proxy.close()
+
+	ch := NewConnHelper(t, "ws://127.0.0.1:3003")
+	ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2})
+	ch.Connect()
+	defer ch.CloseWait()
+
+	var id string
+	if err := ch.Conn.Call(context.Background(), "id", nil, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func() <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			var res string
+			err := ch.Conn.Call(context.Background(), "slow", nil, &res)
+			if err == nil && res != "done" {
+				t.Errorf("expected response: done, got: %v", res)
+			}
+			errs <- err
+		}()
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("request was not received")
+		}
+		return errs
+	}
+
+	// response to a request sent before the connection was lost should be received once the session is resumed
+	errs := call()
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	release <- true
+	proxy.up()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("expected pending request to succeed upon resumption, got: %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected response to be received upon resumption")
+	}
+
+	// request that is lost in transit should be sent again once the session is resumed, and handled only once
+	proxy.stall()
+	lost := make(chan error, 1)
+	go func() {
+		var res string
+		lost <- ch.Conn.Call(context.Background(), "slow", nil, &res)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	proxy.up()
+	select {
+	case <-started:
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected lost request to be sent again upon resumption")
+	}
+	release <- true
+	select {
+	case err := <-lost:
+		if err != nil {
+			t.Fatalf("expected lost request to succeed upon resumption, got: %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected response to be received upon resumption")
+	}
+	select {
+	case <-started:
+		t.Fatal("expected requests to be handled only once")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// pending request should fail once the client reconnects and the session turns out to be expired
+	errs = call()
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	expectString(t, disconns, id, "expected session to expire")
+	release <- true
+	proxy.up()
+	select {
+	case err := <-errs:
+		var cerr *neptulon.CallError
+		if !errors.As(err, &cerr) || cerr.Code != neptulon.ErrCodeDisconnected {
+			t.Fatalf("expected pending request to fail with code %v, got: %v", neptulon.ErrCodeDisconnected, err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected pending request to fail once the session was not resumed")
+	}
+}
+
+func TestSessionResumeQueuedMessages(t *testing.T) {
+	const count, size = 400, 64 << 10
+	sh := NewServerHelper(t)
+	sh.Server.SetResumeGracePeriod(time.Second)
+	if err := sh.Server.SetSendQueueSize(count); err != nil {
+		t.Fatal(err)
+	}
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		ctx.Res = ctx.Conn.ID
+		return ctx.Next()
+	})
+	suspended := make(chan string, 1)
+	sh.Server.EventHandler(func(e *neptulon.Event) {
+		if e.Type == neptulon.EventDisconnected {
+			suspended <- e.Conn.ID
+		}
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	proxy := newDropProxy(t, "127.0.0.1:3003", laddr)
+	defer proxy.close()
+
+	ch := NewConnHelper(t, "ws://127.0.0.1:3003")
+	ch.Conn.SetReconnect(&neptulon.Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 50, Factor: 2})
+	ch.Conn.SetOrdered(true)
+	resumed := make(chan bool, 1)
+	ch.Conn.EventHandler(func(e *neptulon.Event) {
+		if e.Type == neptulon.EventResumed {
+			resumed <- true
+		}
+	})
+	got := make(chan int, count)
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var p struct {
+			N    int
+			Data []byte
+		}
+		if err := ctx.Params(&p); err != nil {
+			return err
+		}
+		got <- p.N
+		return ctx.Next()
+	})
+	ch.Connect()
+	defer ch.CloseWait()
+
+	var id string
+	if err := ch.Conn.Call(context.Background(), "id", nil, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages pile up in the send queue while the connection is stalled, and should be kept once it is lost
+	proxy.stall()
+	data := make([]byte, size)
+	for i := 0; i < count; i++ {
+		if err := sh.Server.SendNotification(id, "n", struct {
+			N    int
+			Data []byte
+		}{i, data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	proxy.drop()
+	expectString(t, suspended, id, "expected session to be suspended")
+	proxy.up()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("client did not resume the session in time")
+	}
+
+	last := -1
+	for last < count-1 {
+		select {
+		case n := <-got:
+			if n <= last {
+				t.Fatalf("expected messages in order, got %v after %v", n, last)
+			}
+			last = n
+		case <-time.After(time.Second * 3):
+			t.Fatalf("expected queued messages to be sent upon resumption, last received: %v", last)
+		}
+	}
+}
+
+func expectString(t *testing.T, ch <-chan string, want, msg string) {
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("%v: expected %v, got: %v", msg, want, got)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal(msg)
+	}
+}
+
+// dropProxy forwards TCP connections to the given address, and can drop them to simulate network failures.
+type dropProxy struct {
+	listener net.Listener
+	target   string
+	mutex    sync.Mutex
+	conns    []net.Conn
+	down     bool          // refuse new connections
+	stalled  chan struct{} // closed once forwarding is resumed, nil if not stalled
+	wg       sync.WaitGroup
+}
+
+func newDropProxy(t *testing.T, addr, target string) *dropProxy {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &dropProxy{listener: l, target: target}
+	p.wg.Add(1)
+	go p.accept()
+	return p
+}
+
+func (p *dropProxy) accept() {
+	defer p.wg.Done()
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		down := p.down
+		p.mutex.Unlock()
+		if down {
+			c.Close()
+			continue
+		}
+
+		t, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		p.mutex.Lock()
+		p.conns = append(p.conns, c, t)
+		p.mutex.Unlock()
+		go p.pipe(c, t)
+		go p.pipe(t, c)
+	}
+}
+
+// pipe forwards the data read from src to dst, waiting while the proxy is stalled.
+func (p *dropProxy) pipe(dst, src net.Conn) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			dst.Close()
+			return
+		}
+		p.mutex.Lock()
+		stalled := p.stalled
+		p.mutex.Unlock()
+		if stalled != nil {
+			<-stalled
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			src.Close()
+			return
+		}
+	}
+}
+
+// stall stops forwarding data without closing the connections, until the connections are dropped.
+func (p *dropProxy) stall() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stalled == nil {
+		p.stalled = make(chan struct{})
+	}
+}
+
+// drop closes all the connections and refuses new ones until up is called.
+func (p *dropProxy) drop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.down = true
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+	if p.stalled != nil {
+		close(p.stalled)
+		p.stalled = nil
+	}
+}
+
+func (p *dropProxy) up() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.down = false
+}
+
+func (p *dropProxy) close() {
+	p.drop()
+	p.listener.Close()
+	p.wg.Wait()
+}
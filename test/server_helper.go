@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"os"
 	"sync"
 	"testing"
@@ -35,13 +36,18 @@ type ServerHelper struct {
 
 // NewServerHelper creates a new server helper object.
 func NewServerHelper(t *testing.T) *ServerHelper {
+	return NewServerHelperAddr(t, laddr)
+}
+
+// NewServerHelperAddr creates a new server helper object listening on the given address, i.e. for multi-node tests.
+func NewServerHelperAddr(t *testing.T, addr string) *ServerHelper {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short testing mode.")
 	}
 
 	return &ServerHelper{
-		Server:  neptulon.NewServer(laddr),
-		Address: laddr,
+		Server:  neptulon.NewServer(addr),
+		Address: addr,
 		testing: t,
 	}
 }
@@ -100,7 +106,11 @@ func (sh *ServerHelper) CloseWait() {
 	}
 
 	sh.listenerWG.Wait()
-	sh.Server.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := sh.Server.Wait(ctx); err != nil {
+		sh.testing.Fatal("Failed to wait for the connections to close:", err)
+	}
 
 	// give connections enough time to disconnect properly
 	if os.Getenv("TRAVIS") != "" || os.Getenv("CI") != "" {
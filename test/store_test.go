@@ -0,0 +1,191 @@
+package test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+)
+
+func TestDeliverToUserMemoryStore(t *testing.T) {
+	testDeliverToUser(t, neptulon.NewMemoryStore())
+}
+
+func TestDeliverToUserFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := neptulon.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDeliverToUser(t, store)
+
+	// stored requests should survive restarts
+	if err := store.Add(&neptulon.StoredRequest{ID: "1", UserID: "bob", Method: "msg"}); err != nil {
+		t.Fatal(err)
+	}
+	store2, err := neptulon.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs, err := store2.Get("bob"); err != nil || len(reqs) != 1 || reqs[0].Method != "msg" {
+		t.Fatalf("expected stored request to be persisted, got: %v, %v", reqs, err)
+	}
+}
+
+// testDeliverToUser sends a request to an offline user and verifies that it is delivered once the user connects and authenticates.
+func testDeliverToUser(t *testing.T, store neptulon.Store) {
+	sh := NewServerHelper(t)
+	sh.Server.SetStore(store)
+	delivered := make(chan string, 1)
+	sh.Server.DeliveryHandler(func(req *neptulon.StoredRequest, ctx *neptulon.ResCtx) {
+		var res string
+		if err := ctx.Result(&res); err != nil {
+			t.Error(err)
+		}
+		delivered <- req.Method + ":" + res
+	})
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var userID string
+		if err := ctx.Params(&userID); err != nil {
+			return err
+		}
+		ctx.Conn.MarkAuthenticated(userID)
+		ctx.Res = "ok"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	id, err := sh.Server.DeliverToUser("alice", "msg", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs, err := store.Get("alice"); err != nil || len(reqs) != 1 || reqs[0].ID != id {
+		t.Fatalf("expected request to be stored for offline user, got: %v, %v", reqs, err)
+	}
+
+	got := make(chan string, 1)
+	ch := sh.GetConnHelper()
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var msg string
+		if err := ctx.Params(&msg); err != nil {
+			return err
+		}
+		got <- ctx.Method + ":" + msg
+		ctx.Res = "thanks"
+		return ctx.Next()
+	})
+	defer ch.Connect().CloseWait()
+	if err := ch.Conn.Call(context.Background(), "login", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-got:
+		if m != "msg:hi" {
+			t.Fatalf("expected stored request to be delivered, got: %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stored request was not delivered after authentication")
+	}
+	select {
+	case m := <-delivered:
+		if m != "msg:thanks" {
+			t.Fatalf("expected delivery handler to be called with the response, got: %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery handler was not called")
+	}
+	if reqs, err := store.Get("alice"); err != nil || len(reqs) != 0 {
+		t.Fatalf("expected answered request to be removed from the store, got: %v, %v", reqs, err)
+	}
+}
+
+func TestDeliverToUserRetry(t *testing.T) {
+	sh := NewServerHelper(t)
+	store := neptulon.NewMemoryStore()
+	sh.Server.SetStore(store)
+	delivered := make(chan string, 2)
+	sh.Server.DeliveryHandler(func(req *neptulon.StoredRequest, ctx *neptulon.ResCtx) {
+		var res string
+		ctx.Result(&res)
+		delivered <- res
+	})
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		ctx.Conn.MarkAuthenticated("alice")
+		ctx.Res = "ok"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	if _, err := sh.Server.DeliverToUser("alice", "msg", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan int, 3)
+	unblock := make(chan struct{})
+	var calls int32
+	ch := sh.GetConnHelper()
+	ch.Conn.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		n := int(atomic.AddInt32(&calls, 1))
+		got <- n
+		if n == 1 {
+			// first delivery is rejected as if the client was busy, after the client re-authenticates
+			<-unblock
+			ctx.Err = &neptulon.ResError{Code: neptulon.ErrCodeServerBusy, Message: "busy"}
+		} else {
+			ctx.Res = "thanks"
+		}
+		return ctx.Next()
+	})
+	defer ch.Connect().CloseWait()
+
+	login := func() {
+		if err := ch.Conn.Call(context.Background(), "login", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCall := func(n int) {
+		select {
+		case m := <-got:
+			if m != n {
+				t.Fatalf("expected delivery attempt %v, got: %v", n, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected delivery attempt %v", n)
+		}
+	}
+
+	login()
+	expectCall(1)
+	login()
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case n := <-got:
+		t.Fatalf("expected pending request not to be sent again upon re-authentication, got delivery attempt: %v", n)
+	default:
+	}
+
+	close(unblock)
+	time.Sleep(time.Millisecond * 100)
+	if reqs, err := store.Get("alice"); err != nil || len(reqs) != 1 {
+		t.Fatalf("expected rejected request to be kept in the store, got: %v, %v", reqs, err)
+	}
+	select {
+	case res := <-delivered:
+		t.Fatalf("expected delivery handler not to be called for rejected request, got: %v", res)
+	default:
+	}
+
+	login()
+	expectCall(2)
+	select {
+	case res := <-delivered:
+		if res != "thanks" {
+			t.Fatalf("expected delivery handler to be called with the response, got: %v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery handler was not called")
+	}
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+)
+
+func TestStream(t *testing.T) {
+	sh := NewServerHelper(t)
+	var sent atomic.Int32
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		var n int
+		if err := ctx.Params(&n); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := ctx.SendChunk(i); err != nil {
+				return err
+			}
+			sent.Add(1)
+		}
+		ctx.Res = "done"
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	ch.Conn.SetStreamWindow(2)
+	ch.Connect()
+	defer ch.CloseWait()
+
+	s, err := ch.Conn.Stream(context.Background(), "count", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// handler should block once the stream window is full
+	if !s.Next() {
+		t.Fatal("expected a chunk")
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := sent.Load(); n > 3 {
+		t.Fatalf("expected handler to wait for the chunks to be read, sent: %v", n)
+	}
+
+	i := 0
+	for {
+		var chunk int
+		if err := s.Chunk(&chunk); err != nil {
+			t.Fatal(err)
+		}
+		if chunk != i {
+			t.Fatalf("expected chunk %v, got: %v", i, chunk)
+		}
+		i++
+		if !s.Next() {
+			break
+		}
+	}
+	if i != 10 {
+		t.Fatalf("expected 10 chunks, got: %v", i)
+	}
+
+	var res string
+	if err := s.Result(&res); err != nil || res != "done" {
+		t.Fatalf("expected final response, got: %v, %v", res, err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	sh := NewServerHelper(t)
+	handlerErr := make(chan error, 1)
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		for i := 0; ; i++ {
+			if err := ctx.SendChunk(i); err != nil {
+				handlerErr <- err
+				return ctx.Next()
+			}
+		}
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper().Connect()
+	defer ch.CloseWait()
+
+	s, err := ch.Conn.Stream(context.Background(), "endless", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !s.Next() {
+			t.Fatal("expected a chunk")
+		}
+	}
+	s.Close()
+
+	// chunks that were already received can still be read after the stream is closed
+	for s.Next() {
+	}
+	var cerr *neptulon.CallError
+	if err := s.Result(nil); !errors.As(err, &cerr) || cerr.Code != neptulon.ErrCodeCanceled {
+		t.Fatalf("expected stream to end with a cancellation error, got: %v", err)
+	}
+
+	select {
+	case err := <-handlerErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected handler to be canceled, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected handler to be canceled")
+	}
+}
+
+func TestStreamNotRequested(t *testing.T) {
+	sh := NewServerHelper(t)
+	if err := sh.Server.SetStreamWindow(0); err == nil {
+		t.Fatal("expected zero stream window to be rejected")
+	}
+	sh.Server.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		// handler should not block when the caller does not read a stream
+		if err := ctx.SendChunk(1); errors.Is(err, neptulon.ErrNotStreaming) {
+			ctx.Res = "not streaming"
+		} else {
+			ctx.Res = "streaming"
+		}
+		return ctx.Next()
+	})
+	defer sh.ListenAndServe().CloseWait()
+
+	ch := sh.GetConnHelper()
+	if err := ch.Conn.SetStreamWindow(0); err == nil {
+		t.Fatal("expected zero stream window to be rejected")
+	}
+	ch.Connect()
+	defer ch.CloseWait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res string
+	if err := ch.Conn.Call(ctx, "chunks", nil, &res); err != nil || res != "not streaming" {
+		t.Fatalf("expected chunks to be rejected for a regular request, got: %v, %v", res, err)
+	}
+
+	s, err := ch.Conn.Stream(ctx, "chunks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for s.Next() {
+	}
+	if err := s.Result(&res); err != nil || res != "streaming" {
+		t.Fatalf("expected chunks to be allowed for a streaming request, got: %v, %v", res, err)
+	}
+}
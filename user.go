@@ -0,0 +1,71 @@
+package neptulon
+
+import (
+	"context"
+	"errors"
+	"expvar"
+)
+
+var usersCounter = expvar.NewInt("users")
+var userConnsCounter = expvar.NewInt("userConns")
+
+// ErrUserNotConnected is returned when sending a message to a user who does not have any authenticated connections.
+var ErrUserNotConnected = errors.New("server: user does not have any connections")
+
+// setUser registers the connection as one of the connections of the user, as the connection is authenticated with Conn.MarkAuthenticated.
+// If the connection was previously authenticated as another user, it is removed from the connections of that user.
+func (s *Server) setUser(c *Conn, userID string) {
+	s.users.mutex.Lock()
+	defer s.users.mutex.Unlock()
+
+	// the check is done while holding the lock so that the connection cannot be removed on disconnection in between
+	if _, ok := s.conns.GetOk(c.ID); !ok {
+		return
+	}
+	for u := range s.users.joined[c.ID] {
+		if u != userID {
+			s.users.leave(c.ID, u)
+		}
+	}
+	s.users.join(c, userID)
+}
+
+// Users returns the IDs of all the users with at least one authenticated connection, in sorted order.
+func (s *Server) Users() []string {
+	return s.users.names()
+}
+
+// UserConns returns the IDs of the authenticated connections of the user, i.e. one for each device of the user, in sorted order.
+// Connections are added once they are authenticated with Conn.MarkAuthenticated, and removed once they are disconnected.
+func (s *Server) UserConns(userID string) []string {
+	return s.users.connIDs(userID)
+}
+
+// SendToUser sends a JSON-RPC notification to all the authenticated connections of the user.
+// Returned map has an entry for each connection denoted by the connection ID, with a nil error if the notification was sent successfully.
+// Returns ErrUserNotConnected if the user does not have any connections.
+func (s *Server) SendToUser(userID string, method string, params interface{}) (map[string]error, error) {
+	if !s.running.Load().(bool) {
+		return nil, errors.New("use of closed server")
+	}
+
+	conns := s.users.conns(userID)
+	if len(conns) == 0 {
+		return nil, ErrUserNotConnected
+	}
+	return notifyEach(conns, method, params), nil
+}
+
+// SendRequestToUser sends a JSON-RPC request to all the authenticated connections of the user and collects their responses.
+// Returns ErrUserNotConnected if the user does not have any connections. See MulticastRequest for details.
+func (s *Server) SendRequestToUser(ctx context.Context, userID string, method string, params interface{}) (*BroadcastResult, error) {
+	if !s.running.Load().(bool) {
+		return nil, errors.New("use of closed server")
+	}
+
+	conns := s.users.conns(userID)
+	if len(conns) == 0 {
+		return nil, ErrUserNotConnected
+	}
+	return requestAll(ctx, conns, method, params), nil
+}
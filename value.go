@@ -0,0 +1,789 @@
+package neptulon
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Binary codecs convert Go values into generic values, which are then encoded in the wire format, and the other way around.
+// Generic values are nil, bool, int64, uint64, float64, json.Number, string, []byte, []interface{} and map[string]interface{}.
+// Conversions follow the encoding/json rules, including struct tags and json.Marshaler and json.Unmarshaler implementations,
+// except that []byte values are kept as binary values instead of being converted into base64 encoded strings.
+
+// valueCodec is implemented by the binary codecs, to encode and decode generic values.
+type valueCodec interface {
+	encodeValue(v interface{}) ([]byte, error)
+	decodeValue(data []byte) (interface{}, error)
+}
+
+// marshalBinary encodes the Go value with the binary codec.
+func marshalBinary(c valueCodec, v interface{}) ([]byte, error) {
+	g, err := genericValue(reflect.ValueOf(v), 0)
+	if err != nil {
+		return nil, err
+	}
+	return c.encodeValue(g)
+}
+
+// unmarshalBinary decodes the data with the binary codec into the Go value, which should be a non-nil pointer.
+func unmarshalBinary(c Codec, data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	g, err := c.(valueCodec).decodeValue(data)
+	if err != nil {
+		return err
+	}
+	d := valueDecoder{codec: c}
+	return d.decode(g, rv)
+}
+
+// rawValue is a value kept in the wire format of the codec that it was received with, to be decoded once it is read.
+// Request params, response results and stream chunks are kept this way.
+type rawValue struct {
+	codec Codec
+	data  []byte // nil if the value was not present in the message
+}
+
+// jsonValue wraps the raw JSON value, which is nil if the value was not present.
+func jsonValue(data json.RawMessage) rawValue {
+	return rawValue{codec: JSONCodec, data: data}
+}
+
+// unmarshal decodes the value into v with the codec that it was received with.
+func (r rawValue) unmarshal(v interface{}) error {
+	if r.codec == nil {
+		return json.Unmarshal(r.data, v)
+	}
+	return r.codec.Unmarshal(r.data, v)
+}
+
+// json returns the value in JSON, or nil if the value was not present.
+func (r rawValue) json() (json.RawMessage, error) {
+	if r.data == nil {
+		return nil, nil
+	}
+	return r.MarshalJSON()
+}
+
+// MarshalJSON converts the value into JSON, so that it can be sent through connections with any codec.
+func (r rawValue) MarshalJSON() ([]byte, error) {
+	if r.data == nil {
+		return []byte("null"), nil
+	}
+	vc, ok := r.codec.(valueCodec)
+	if !ok {
+		return r.data, nil
+	}
+	v, err := vc.decodeValue(r.data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON keeps a copy of the raw JSON value.
+func (r *rawValue) UnmarshalJSON(data []byte) error {
+	r.codec = JSONCodec
+	r.data = append([]byte(nil), data...)
+	return nil
+}
+
+var (
+	marshalerType       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	numberType          = reflect.TypeOf(json.Number(""))
+	rawValueType        = reflect.TypeOf(rawValue{})
+)
+
+// genericValue converts the Go value into a generic value, the same way as encoding/json would encode it.
+func genericValue(v reflect.Value, depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("codec: value nesting depth exceeds %v", maxDecodeDepth)
+	}
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, nil
+	}
+
+	t := v.Type()
+	switch {
+	case t == rawValueType:
+		r := v.Interface().(rawValue)
+		if vc, ok := r.codec.(valueCodec); ok && r.data != nil {
+			return vc.decodeValue(r.data)
+		}
+		data, err := r.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSONValue(data)
+	case t.Implements(marshalerType):
+		return marshalerValue(v.Interface().(json.Marshaler))
+	case v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(t).Implements(marshalerType):
+		return marshalerValue(v.Addr().Interface().(json.Marshaler))
+	case t.Implements(textMarshalerType):
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("codec: unsupported value: %v", f)
+		}
+		return f, nil
+	case reflect.String:
+		if t == numberType {
+			if v.String() == "" {
+				return json.Number("0"), nil
+			}
+			return json.Number(v.String()), nil
+		}
+		return v.String(), nil
+	case reflect.Interface, reflect.Ptr:
+		return genericValue(v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if isByteSlice(t) {
+			return v.Bytes(), nil
+		}
+		fallthrough
+	case reflect.Array:
+		a := make([]interface{}, v.Len())
+		for i := range a {
+			e, err := genericValue(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = e
+		}
+		return a, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := mapKeyString(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = genericValue(iter.Value(), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		for _, f := range cachedFields(t) {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			if f.quoted {
+				data, err := json.Marshal(fv.Interface())
+				if err != nil {
+					return nil, err
+				}
+				m[f.name] = string(data)
+				continue
+			}
+			e, err := genericValue(fv, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = e
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("codec: unsupported type: %v", t)
+}
+
+// marshalerValue converts the JSON returned by the marshaler into a generic value.
+func marshalerValue(m json.Marshaler) (interface{}, error) {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSONValue(data)
+}
+
+// isByteSlice checks if the slice type is encoded as binary data, which is the case for []byte
+// unless its elements implement json.Marshaler or encoding.TextMarshaler, same as encoding/json.
+func isByteSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+	p := reflect.PtrTo(t.Elem())
+	return !p.Implements(marshalerType) && !p.Implements(textMarshalerType)
+}
+
+// mapKeyString converts the map key into an object key.
+func mapKeyString(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("codec: unsupported map key type: %v", k.Type())
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is a struct field as seen by encoding/json.
+type field struct {
+	name      string
+	index     []int // index sequence for reflect.Value.FieldByIndex
+	tagged    bool  // name comes from the struct tag
+	omitEmpty bool
+	quoted    bool // encoded as a JSON string with the "string" tag option
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+// cachedFields returns the fields of the struct type, computing them only once per type.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields returns the fields of the struct type that encoding/json would encode, including the fields of embedded structs.
+// Among fields with the same name, the least nested one wins, or the tagged one if there are more than one at the same depth.
+// If there is still a tie, none of them are encoded.
+func typeFields(t reflect.Type) []field {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var fields []field
+	seen := make(map[string]bool) // names of the fields at shallower depths
+	visited := make(map[reflect.Type]bool)
+	for level := []embedded{{typ: t}}; len(level) > 0; {
+		var next []embedded
+		var names []string
+		byName := make(map[string][]field)
+		for _, e := range level {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				ft := sf.Type
+				if sf.Anonymous && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if !sf.IsExported() && (!sf.Anonymous || ft.Kind() != reflect.Struct) {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int(nil), e.index...), i)
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: index})
+					continue
+				}
+
+				f := field{name: name, index: index, tagged: name != "", omitEmpty: hasOption(opts, "omitempty")}
+				if f.name == "" {
+					f.name = sf.Name
+				}
+				if hasOption(opts, "string") {
+					switch sf.Type.Kind() {
+					case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+						reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+						f.quoted = true
+					}
+				}
+				if _, ok := byName[f.name]; !ok {
+					names = append(names, f.name)
+				}
+				byName[f.name] = append(byName[f.name], f)
+			}
+		}
+
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			fs := byName[name]
+			if len(fs) == 1 {
+				fields = append(fields, fs[0])
+				continue
+			}
+			var tagged []field
+			for _, f := range fs {
+				if f.tagged {
+					tagged = append(tagged, f)
+				}
+			}
+			if len(tagged) == 1 {
+				fields = append(fields, tagged[0])
+			}
+		}
+		level = next
+	}
+	return fields
+}
+
+func hasOption(opts, opt string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldByIndex returns the nested struct field, or false if it is within a nil embedded struct pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// valueDecoder stores generic values decoded by a binary codec into Go values, the same way as encoding/json would decode them.
+type valueDecoder struct {
+	codec Codec
+}
+
+func (d *valueDecoder) decode(g interface{}, v reflect.Value) error {
+	u, tu, v := indirect(v, g == nil)
+	if u != nil {
+		// raw values are kept in the wire format
+		if r, ok := u.(*rawValue); ok {
+			data, err := d.codec.(valueCodec).encodeValue(g)
+			r.codec, r.data = d.codec, data
+			return err
+		}
+		data, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalJSON(data)
+	}
+	if tu != nil {
+		switch g := g.(type) {
+		case string:
+			return tu.UnmarshalText([]byte(g))
+		case []byte:
+			return tu.UnmarshalText(g)
+		}
+		return typeError(g, reflect.TypeOf(tu))
+	}
+
+	switch g := g.(type) {
+	case nil:
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	case bool:
+		switch {
+		case v.Kind() == reflect.Bool:
+			v.SetBool(g)
+		case isEmptyInterface(v):
+			v.Set(reflect.ValueOf(g))
+		default:
+			return typeError(g, v.Type())
+		}
+		return nil
+	case string:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(g)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			// binary data from JSON peers
+			b, err := base64.StdEncoding.DecodeString(g)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+		case isEmptyInterface(v):
+			v.Set(reflect.ValueOf(g))
+		default:
+			return typeError(g, v.Type())
+		}
+		return nil
+	case []byte:
+		b := append([]byte{}, g...)
+		switch {
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(b)
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			reflect.Copy(v, reflect.ValueOf(b))
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case isEmptyInterface(v):
+			v.Set(reflect.ValueOf(b))
+		default:
+			return typeError(g, v.Type())
+		}
+		return nil
+	case []interface{}:
+		return d.array(g, v)
+	case map[string]interface{}:
+		return d.object(g, v)
+	}
+	return d.number(g, v)
+}
+
+// indirect walks down the pointers, allocating them as needed, until it gets to a non-pointer value, same as encoding/json.
+// If a json.Unmarshaler or encoding.TextUnmarshaler is found on the way, it stops and returns it.
+// If null is true, it stops at the last settable pointer so that it can be set to nil.
+func indirect(v reflect.Value, null bool) (json.Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	// start from the address of named values so that methods with pointer receivers are found
+	v0 := v
+	haveAddr := false
+	if v.Kind() != reflect.Ptr && v.Type().Name() != "" && v.CanAddr() {
+		haveAddr = true
+		v = v.Addr()
+	}
+	for {
+		// load the value from an interface, but only if the result will be usefully addressable
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Ptr && !e.IsNil() && (!null || e.Elem().Kind() == reflect.Ptr) {
+				haveAddr = false
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if null && v.CanSet() {
+			break
+		}
+		// prevent infinite loops if v is an interface pointing to its own address
+		if v.Elem().Kind() == reflect.Interface && v.Elem().Elem().Equal(v) {
+			v = v.Elem()
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().NumMethod() > 0 && v.CanInterface() {
+			if u, ok := v.Interface().(json.Unmarshaler); ok {
+				return u, nil, reflect.Value{}
+			}
+			if !null {
+				if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+					return nil, u, reflect.Value{}
+				}
+			}
+		}
+
+		if haveAddr {
+			v = v0
+			haveAddr = false
+		} else {
+			v = v.Elem()
+		}
+	}
+	return nil, nil, v
+}
+
+func (d *valueDecoder) array(a []interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !isEmptyInterface(v) {
+			return typeError(a, v.Type())
+		}
+		v.Set(reflect.ValueOf(interfaceValue(a)))
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), len(a), len(a))
+		for i, e := range a {
+			if err := d.decode(e, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(a) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := d.decode(a[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return typeError(a, v.Type())
+	}
+	return nil
+}
+
+func (d *valueDecoder) object(m map[string]interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !isEmptyInterface(v) {
+			return typeError(m, v.Type())
+		}
+		v.Set(reflect.ValueOf(interfaceValue(m)))
+	case reflect.Map:
+		t := v.Type()
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		for k, e := range m {
+			kv, err := mapKeyValue(k, t.Key())
+			if err != nil {
+				return err
+			}
+			ev := reflect.New(t.Elem()).Elem()
+			if err := d.decode(e, ev); err != nil {
+				return err
+			}
+			v.SetMapIndex(kv, ev)
+		}
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		for k, e := range m {
+			f := findField(fields, k)
+			if f == nil {
+				continue
+			}
+			fv, err := settableField(v, f.index)
+			if err != nil {
+				return err
+			}
+			if s, ok := e.(string); ok && f.quoted {
+				if err := json.Unmarshal([]byte(s), fv.Addr().Interface()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(e, fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return typeError(m, v.Type())
+	}
+	return nil
+}
+
+func (d *valueDecoder) number(g interface{}, v reflect.Value) error {
+	var n string
+	switch g := g.(type) {
+	case int64:
+		n = strconv.FormatInt(g, 10)
+	case uint64:
+		n = strconv.FormatUint(g, 10)
+	case float64:
+		n = strconv.FormatFloat(g, 'g', -1, 64)
+	case json.Number:
+		n = string(g)
+	default:
+		return fmt.Errorf("codec: unsupported generic value type: %T", g)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if !isEmptyInterface(v) {
+			return typeError(g, v.Type())
+		}
+		v.Set(reflect.ValueOf(interfaceValue(g)))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || v.OverflowInt(i) {
+			return typeError(g, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(n, 10, 64)
+		if err != nil || v.OverflowUint(u) {
+			return typeError(g, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(n, v.Type().Bits())
+		if err != nil || v.OverflowFloat(f) {
+			return typeError(g, v.Type())
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if v.Type() != numberType {
+			return typeError(g, v.Type())
+		}
+		v.SetString(n)
+	default:
+		return typeError(g, v.Type())
+	}
+	return nil
+}
+
+// interfaceValue converts the generic value into the value that encoding/json would store in an empty interface,
+// except for binary data which is kept as []byte.
+func interfaceValue(g interface{}) interface{} {
+	switch g := g.(type) {
+	case int64:
+		return float64(g)
+	case uint64:
+		return float64(g)
+	case json.Number:
+		f, _ := g.Float64()
+		return f
+	case []interface{}:
+		for i, e := range g {
+			g[i] = interfaceValue(e)
+		}
+	case map[string]interface{}:
+		for k, e := range g {
+			g[k] = interfaceValue(e)
+		}
+	}
+	return g
+}
+
+func isEmptyInterface(v reflect.Value) bool {
+	return v.Kind() == reflect.Interface && v.NumMethod() == 0
+}
+
+// mapKeyValue converts the object key into a map key of the given type.
+func mapKeyValue(k string, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() != reflect.String && reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		kv := reflect.New(t)
+		err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(k))
+		return kv.Elem(), err
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(k).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(k, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowInt(i) {
+			return reflect.Value{}, typeError(k, t)
+		}
+		return reflect.ValueOf(i).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowUint(u) {
+			return reflect.Value{}, typeError(k, t)
+		}
+		return reflect.ValueOf(u).Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("codec: unsupported map key type: %v", t)
+}
+
+// findField returns the field with the given name, preferring an exact match over a case-insensitive one, same as encoding/json.
+func findField(fields []field, name string) *field {
+	var fold *field
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// settableField returns the nested struct field, allocating the nil embedded struct pointers on the way.
+func settableField(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("codec: cannot set embedded pointer to unexported struct: %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// typeError returns the error for a generic value that cannot be stored into a Go value of the given type.
+func typeError(g interface{}, t reflect.Type) error {
+	var kind string
+	switch g.(type) {
+	case bool:
+		kind = "bool"
+	case string:
+		kind = "string"
+	case []byte:
+		kind = "binary"
+	case []interface{}:
+		kind = "array"
+	case map[string]interface{}:
+		kind = "object"
+	default:
+		kind = "number"
+	}
+	return fmt.Errorf("codec: cannot unmarshal %v into Go value of type %v", kind, t)
+}